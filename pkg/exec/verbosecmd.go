@@ -30,3 +30,16 @@ func (v VerboseCmd) Run() error {
 
 	return nil
 }
+
+// Output executes the command and returns its standard output, stderr is contained in the error in case it fails.
+func (v VerboseCmd) Output() (string, error) {
+	var stderr bytes.Buffer
+	v.Cmd.Stderr = &stderr
+
+	out, err := v.Cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, stderr.String())
+	}
+
+	return string(out), nil
+}
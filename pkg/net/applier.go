@@ -79,6 +79,35 @@ func (n *networkApplier) Apply(tpl template.Template, tmpFile, destFile string,
 	return true, nil
 }
 
+// WithReloader returns an applier that behaves like the given one but reloads with the given reloader.
+func WithReloader(a Applier, r Reloader) Applier {
+	return reloadingApplier{Applier: a, r: r}
+}
+
+// reloadingApplier overrides the reloader of an applier.
+type reloadingApplier struct {
+	Applier
+	r Reloader
+}
+
+// Reload reloads with the overridden reloader.
+func (a reloadingApplier) Reload() error {
+	return a.r.Reload()
+}
+
+func (a reloadingApplier) reloadedBy() Reloader {
+	return a.r
+}
+
+func (a reloadingApplier) validatedBy() Validator {
+	p, ok := a.Applier.(interface{ validatedBy() Validator })
+	if !ok {
+		return nil
+	}
+
+	return p.validatedBy()
+}
+
 // Render renders the network interfaces to the given writer using the given template.
 func (n *networkApplier) Render(w io.Writer, tpl template.Template) error {
 	return tpl.Execute(w, n.data)
@@ -94,6 +123,16 @@ func (n *networkApplier) Reload() error {
 	return n.reloader.Reload()
 }
 
+// reloadedBy returns the reloader of this applier, it is used to reload every service only once per transaction.
+func (n *networkApplier) reloadedBy() Reloader {
+	return n.reloader
+}
+
+// validatedBy returns the validator of this applier, it is used to report how an artifact was validated.
+func (n *networkApplier) validatedBy() Validator {
+	return n.validator
+}
+
 // Compare compare source and target for hash equality.
 func (n *networkApplier) Compare(source, target string) bool {
 	sourceChecksum, err := checksum(source)
@@ -0,0 +1,50 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// FileDiff describes the pending change of a destination file.
+type FileDiff struct {
+	// Dest is the destination file.
+	Dest string
+	// Changed is true if the rendered file differs from the destination file.
+	Changed bool
+	// Diff holds the unified diff between the destination file and the rendered file, it is empty if unchanged.
+	Diff string
+}
+
+// String returns the unified diff of a changed file or a marker for an unchanged file.
+func (d FileDiff) String() string {
+	if !d.Changed {
+		return fmt.Sprintf("unchanged: %s\n", d.Dest)
+	}
+
+	return d.Diff
+}
+
+// unifiedDiff returns the unified diff to turn destFile into source. A missing destFile is treated as empty file.
+func unifiedDiff(source, destFile string) (string, error) {
+	after, err := os.ReadFile(source)
+	if err != nil {
+		return "", err
+	}
+
+	before, err := os.ReadFile(destFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: path.Join("a", destFile),
+		ToFile:   path.Join("b", destFile),
+		Context:  3,
+	})
+}
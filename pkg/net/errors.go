@@ -0,0 +1,69 @@
+package net
+
+import "fmt"
+
+// Phase names the step in which applying an artifact failed.
+type Phase string
+
+const (
+	// PhaseRender is the phase in which an artifact is rendered into a temporary file.
+	PhaseRender = Phase("render")
+	// PhaseValidate is the phase in which a rendered artifact is validated.
+	PhaseValidate = Phase("validate")
+	// PhaseCompare is the phase in which a rendered artifact is compared with its destination.
+	PhaseCompare = Phase("compare")
+	// PhaseRename is the phase in which a rendered artifact is moved to its destination.
+	PhaseRename = Phase("rename")
+	// PhaseChmod is the phase in which the file mode of the destination is set.
+	PhaseChmod = Phase("chmod")
+	// PhaseReload is the phase in which a service is reloaded to pick up a changed artifact.
+	PhaseReload = Phase("reload")
+	// PhaseEnable is the phase in which a systemd unit is enabled.
+	PhaseEnable = Phase("enable")
+	// PhaseRollback is the phase in which a destination is restored after a failed commit.
+	PhaseRollback = Phase("rollback")
+)
+
+// ApplyError describes the failure of a single artifact in a certain phase.
+type ApplyError struct {
+	// Artifact is the destination file or the unit the error belongs to.
+	Artifact string
+	// Phase is the step in which the error occurred.
+	Phase Phase
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("%s of %s failed: %v", e.Phase, e.Artifact, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyErrors returns all ApplyErrors contained in the given, possibly joined, error.
+func ApplyErrors(err error) []*ApplyError {
+	if err == nil {
+		return nil
+	}
+
+	if ae, ok := err.(*ApplyError); ok {
+		return []*ApplyError{ae}
+	}
+
+	var result []*ApplyError
+
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, inner := range e.Unwrap() {
+			result = append(result, ApplyErrors(inner)...)
+		}
+	case interface{ Unwrap() error }:
+		result = append(result, ApplyErrors(e.Unwrap())...)
+	}
+
+	return result
+}
@@ -0,0 +1,54 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyErrors(t *testing.T) {
+	render := &ApplyError{Artifact: "/etc/hosts", Phase: PhaseRender, Err: errors.New("no space left on device")}
+	validate := &ApplyError{Artifact: "/etc/nftables/rules", Phase: PhaseValidate, Err: errors.New("syntax error")}
+	enable := &ApplyError{Artifact: "node-exporter.service", Phase: PhaseEnable, Err: errors.New("exit status 1")}
+
+	tests := []struct {
+		name string
+		err  error
+		want []*ApplyError
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			want: nil,
+		},
+		{
+			name: "plain error",
+			err:  errors.New("plain"),
+			want: nil,
+		},
+		{
+			name: "single",
+			err:  render,
+			want: []*ApplyError{render},
+		},
+		{
+			name: "joined and wrapped",
+			err:  errors.Join(render, fmt.Errorf("wrapped: %w", errors.Join(validate, nil, enable))),
+			want: []*ApplyError{render, validate, enable},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ApplyErrors(tt.err))
+		})
+	}
+}
+
+func TestApplyError_Error(t *testing.T) {
+	err := &ApplyError{Artifact: "/etc/frr/frr.conf", Phase: PhaseValidate, Err: errors.New("exit status 1")}
+	assert.Equal(t, "validate of /etc/frr/frr.conf failed: exit status 1", err.Error())
+	assert.ErrorIs(t, fmt.Errorf("configure: %w", err), err.Err)
+}
@@ -14,6 +14,13 @@ type Reloader interface {
 	Reload() error
 }
 
+// RollbackReloader is a reloader that does not load the destination file but a state held in memory. Reloading it
+// after a rollback would load the rejected state again, Rollback is called instead to load the restored file.
+type RollbackReloader interface {
+	Reloader
+	Rollback() error
+}
+
 // NewDBusReloader is a reloader for systemd units with dbus.
 func NewDBusReloader(service string) dbusReloader {
 	return dbusReloader{
@@ -49,3 +56,45 @@ func (r dbusReloader) Reload() error {
 
 	return nil
 }
+
+// NewDBusRestarter is a reloader for systemd units that lets systemd reload its unit files and restarts the given
+// unit if it is running.
+func NewDBusRestarter(service string) dbusRestarter {
+	return dbusRestarter{
+		serviceFilename: service,
+	}
+}
+
+// dbusRestarter applies a changed systemd unit file by reloading systemd and restarting the unit.
+type dbusRestarter struct {
+	serviceFilename string
+}
+
+// Reload reloads the systemd manager configuration and restarts the unit if it is running.
+func (r dbusRestarter) Reload() error {
+	ctx := context.Background()
+	dbc, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to connect to dbus: %w", err)
+	}
+	defer dbc.Close()
+
+	err = dbc.ReloadContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	c := make(chan string)
+	_, err = dbc.TryRestartUnitContext(ctx, r.serviceFilename, "replace", c)
+
+	if err != nil {
+		return err
+	}
+
+	job := <-c
+	if job != done {
+		return fmt.Errorf("restarting failed %s", job)
+	}
+
+	return nil
+}
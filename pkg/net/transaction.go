@@ -0,0 +1,413 @@
+package net
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"text/template"
+	"time"
+)
+
+// Transaction stages the changes of several appliers and commits them together.
+// All files are rendered and validated before any destination is touched. In case a commit step or a reload fails,
+// every destination file changed so far is restored to its previous version.
+type Transaction struct {
+	dir       string
+	staged    []stagedFile
+	artifacts []Artifact
+}
+
+// Artifact describes how a single destination file was handled by a transaction.
+type Artifact struct {
+	// Dest is the destination file.
+	Dest string
+	// Mode is the file mode of the destination file.
+	Mode os.FileMode
+	// RenderDuration is the time it took to render the artifact.
+	RenderDuration time.Duration
+	// ValidateDuration is the time it took to validate the artifact.
+	ValidateDuration time.Duration
+	// Validator is the type name of the validator used, it is empty if unknown.
+	Validator string
+	// SHA256Before is the hex encoded sha256 checksum of the destination file before the commit, it is empty if
+	// the file did not exist.
+	SHA256Before string
+	// SHA256After is the hex encoded sha256 checksum of the destination file after the commit, it is empty if the
+	// file does not exist.
+	SHA256After string
+	// Changed is true if the destination file was replaced and not restored afterwards.
+	Changed bool
+	// Reloaded is true if a reload of a service was triggered because of the artifact.
+	Reloaded bool
+	// Err is the error of the artifact, it is nil as long as nothing failed.
+	Err *ApplyError
+}
+
+// stagedFile holds a rendered and validated file that waits to be moved to its destination.
+type stagedFile struct {
+	applier  Applier
+	tmpFile  string
+	destFile string
+	mode     os.FileMode
+	reload   bool
+	artifact int
+}
+
+// backup holds the previous state of a destination file to be able to restore it.
+type backup struct {
+	destFile string
+	existed  bool
+	content  []byte
+	mode     os.FileMode
+	artifact int
+}
+
+// NewTransaction creates a new empty Transaction that stages its temporary files in the given directory.
+func NewTransaction(dir string) *Transaction {
+	return &Transaction{dir: dir}
+}
+
+// TmpFile creates a new empty temporary file in the staging directory of the transaction and returns its name.
+func (t *Transaction) TmpFile(prefix string) (string, error) {
+	f, err := os.CreateTemp(t.dir, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// Stage renders the given template with the applier into tmpFile and validates the result.
+// The destination file is not touched until Commit is called. In case of an error tmpFile is removed and an
+// ApplyError is returned.
+func (t *Transaction) Stage(a Applier, tpl template.Template, tmpFile, destFile string, mode os.FileMode, reload bool) error {
+	artifact := Artifact{Dest: destFile, Mode: mode, Validator: validatorName(a)}
+	phase, err := renderAndValidate(a, tpl, tmpFile, &artifact)
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		artifact.Err = &ApplyError{Artifact: destFile, Phase: phase, Err: err}
+		t.artifacts = append(t.artifacts, artifact)
+		return artifact.Err
+	}
+
+	t.staged = append(t.staged, stagedFile{
+		applier:  a,
+		tmpFile:  tmpFile,
+		destFile: destFile,
+		mode:     mode,
+		reload:   reload,
+		artifact: len(t.artifacts),
+	})
+	t.artifacts = append(t.artifacts, artifact)
+
+	return nil
+}
+
+func renderAndValidate(a Applier, tpl template.Template, tmpFile string, artifact *Artifact) (Phase, error) {
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return PhaseRender, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	start := time.Now()
+	w := bufio.NewWriter(f)
+	err = a.Render(w, tpl)
+	if err != nil {
+		return PhaseRender, err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return PhaseRender, err
+	}
+	artifact.RenderDuration = time.Since(start)
+
+	start = time.Now()
+	err = a.Validate()
+	artifact.ValidateDuration = time.Since(start)
+	if err != nil {
+		return PhaseValidate, err
+	}
+
+	return "", nil
+}
+
+// Len returns the number of staged files.
+func (t *Transaction) Len() int {
+	return len(t.staged)
+}
+
+// Staged returns the temporary file of every staged file by its destination.
+func (t *Transaction) Staged() map[string]string {
+	result := map[string]string{}
+	for _, s := range t.staged {
+		result[s.destFile] = s.tmpFile
+	}
+
+	return result
+}
+
+// Artifacts returns all artifacts handled by the transaction so far, including those that failed to stage.
+func (t *Transaction) Artifacts() []Artifact {
+	return slices.Clone(t.artifacts)
+}
+
+// Commit moves all staged files that differ from their destination into place and reloads the affected services.
+// If any of these steps fails, all changed destination files are restored and the services already reloaded are
+// reloaded again to pick up the previous configuration. The returned error contains an ApplyError for the failed
+// step and for every failed rollback step.
+func (t *Transaction) Commit() error {
+	defer t.Discard()
+
+	var (
+		backups  []backup
+		reloads  []stagedFile
+		reloaded []stagedFile
+	)
+
+	for _, s := range t.staged {
+		sum := hexChecksum(s.destFile)
+		t.artifacts[s.artifact].SHA256Before = sum
+		t.artifacts[s.artifact].SHA256After = sum
+	}
+
+	for _, s := range t.staged {
+		if s.applier.Compare(s.tmpFile, s.destFile) {
+			err := os.Chmod(s.destFile, s.mode)
+			if err != nil {
+				return t.rollback(backups, reloaded, t.fail(s, PhaseChmod, err))
+			}
+			continue
+		}
+
+		b, err := newBackup(s.destFile, s.artifact)
+		if err != nil {
+			return t.rollback(backups, reloaded, t.fail(s, PhaseCompare, err))
+		}
+		backups = append(backups, b)
+
+		err = os.MkdirAll(filepath.Dir(s.destFile), 0755)
+		if err != nil {
+			return t.rollback(backups, reloaded, t.fail(s, PhaseRename, err))
+		}
+
+		sum := hexChecksum(s.tmpFile)
+		err = os.Rename(s.tmpFile, s.destFile)
+		if err != nil {
+			return t.rollback(backups, reloaded, t.fail(s, PhaseRename, err))
+		}
+
+		t.artifacts[s.artifact].Changed = true
+		t.artifacts[s.artifact].SHA256After = sum
+
+		err = os.Chmod(s.destFile, s.mode)
+		if err != nil {
+			return t.rollback(backups, reloaded, t.fail(s, PhaseChmod, err))
+		}
+
+		if s.reload && !containsReloader(reloads, s.applier) {
+			reloads = append(reloads, s)
+		}
+	}
+
+	for _, s := range reloads {
+		reloaded = append(reloaded, s)
+		t.artifacts[s.artifact].Reloaded = true
+		err := s.applier.Reload()
+		if err != nil {
+			return t.rollback(backups, reloaded, t.fail(s, PhaseReload, err))
+		}
+	}
+
+	return nil
+}
+
+// Plan compares all staged files with their destination and returns the pending changes without touching any
+// destination. The staged files are kept, the transaction can be committed or discarded afterwards.
+func (t *Transaction) Plan() ([]FileDiff, error) {
+	var result []FileDiff
+
+	for _, s := range t.staged {
+		d := FileDiff{Dest: s.destFile}
+		if s.applier.Compare(s.tmpFile, s.destFile) {
+			result = append(result, d)
+			continue
+		}
+
+		diff, err := unifiedDiff(s.tmpFile, s.destFile)
+		if err != nil {
+			return nil, t.fail(s, PhaseCompare, err)
+		}
+
+		d.Changed = true
+		d.Diff = diff
+		result = append(result, d)
+	}
+
+	return result, nil
+}
+
+// Discard removes all staged temporary files without touching any destination.
+func (t *Transaction) Discard() {
+	for _, s := range t.staged {
+		_ = os.Remove(s.tmpFile)
+	}
+	t.staged = nil
+}
+
+func newBackup(destFile string, artifact int) (backup, error) {
+	b := backup{destFile: destFile, artifact: artifact}
+
+	info, err := os.Stat(destFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return b, err
+	}
+
+	content, err := os.ReadFile(destFile)
+	if err != nil {
+		return b, err
+	}
+
+	b.existed = true
+	b.content = content
+	b.mode = info.Mode().Perm()
+
+	return b, nil
+}
+
+// restore puts the previous version of the destination file back into place.
+func (b backup) restore() error {
+	if !b.existed {
+		err := os.Remove(b.destFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	tmpFile := b.destFile + ".rollback"
+	err := os.WriteFile(tmpFile, b.content, b.mode)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpFile, b.mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, b.destFile)
+}
+
+// containsReloader returns true if any of the given staged files is reloaded by the same reloader as the applier.
+// Appliers whose reloader is unknown or not comparable are never considered to be contained.
+func containsReloader(staged []stagedFile, a Applier) bool {
+	r := reloaderOf(a)
+	if r == nil {
+		return false
+	}
+
+	for _, s := range staged {
+		if reloaderOf(s.applier) == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+func reloaderOf(a Applier) Reloader {
+	p, ok := a.(interface{ reloadedBy() Reloader })
+	if !ok {
+		return nil
+	}
+
+	r := p.reloadedBy()
+	if r == nil || !reflect.TypeOf(r).Comparable() {
+		return nil
+	}
+
+	return r
+}
+
+// reloadRestored lets the service of the given applier pick up its restored destination file.
+func reloadRestored(a Applier) error {
+	p, ok := a.(interface{ reloadedBy() Reloader })
+	if ok {
+		if r, ok := p.reloadedBy().(RollbackReloader); ok {
+			return r.Rollback()
+		}
+	}
+
+	return a.Reload()
+}
+
+// validatorName returns the type name of the validator of the given applier or an empty string if it is unknown.
+func validatorName(a Applier) string {
+	p, ok := a.(interface{ validatedBy() Validator })
+	if !ok || p.validatedBy() == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%T", p.validatedBy())
+}
+
+// hexChecksum returns the hex encoded sha256 checksum of the given file or an empty string if it cannot be read.
+func hexChecksum(file string) string {
+	sum, err := checksum(file)
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(sum)
+}
+
+// fail records the error of the given staged file in its artifact and returns it.
+func (t *Transaction) fail(s stagedFile, phase Phase, err error) error {
+	ae := &ApplyError{Artifact: s.destFile, Phase: phase, Err: err}
+	t.artifacts[s.artifact].Err = ae
+	return ae
+}
+
+// rollback restores the given backups in reverse order and reloads the services of the given staged files to let
+// them pick up the restored files. Services with a RollbackReloader are rolled back instead of reloaded. The returned error joins the cause of the rollback and all errors that occurred
+// while rolling back.
+func (t *Transaction) rollback(backups []backup, reloaded []stagedFile, cause error) error {
+	errs := []error{cause}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		err := backups[i].restore()
+		if err != nil {
+			errs = append(errs, &ApplyError{Artifact: backups[i].destFile, Phase: PhaseRollback, Err: err})
+			continue
+		}
+		t.artifacts[backups[i].artifact].Changed = false
+		t.artifacts[backups[i].artifact].SHA256After = t.artifacts[backups[i].artifact].SHA256Before
+	}
+
+	for _, s := range reloaded {
+		err := reloadRestored(s.applier)
+		if err != nil {
+			errs = append(errs, &ApplyError{Artifact: s.destFile, Phase: PhaseRollback, Err: err})
+		}
+	}
+
+	return errors.Join(errs...)
+}
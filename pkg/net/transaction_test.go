@@ -0,0 +1,245 @@
+package net
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type validatorFunc func() error
+
+func (f validatorFunc) Validate() error {
+	return f()
+}
+
+type reloaderFunc func() error
+
+func (f reloaderFunc) Reload() error {
+	return f()
+}
+
+func TestTransaction(t *testing.T) {
+	noop := func() error { return nil }
+	fail := func() error { return errors.New("failed") }
+
+	tests := []struct {
+		name      string
+		validate  func() error
+		reload    func() error
+		wantErr   bool
+		wantPhase Phase
+		wantFirst string
+		wantOther string
+	}{
+		{
+			name:      "commit applies all files",
+			validate:  noop,
+			reload:    noop,
+			wantFirst: "new first",
+			wantOther: "new other",
+		},
+		{
+			name:      "failed validation touches nothing",
+			validate:  fail,
+			reload:    noop,
+			wantErr:   true,
+			wantPhase: PhaseValidate,
+			wantFirst: "old first",
+		},
+		{
+			name:      "failed reload restores previous versions",
+			validate:  noop,
+			reload:    fail,
+			wantErr:   true,
+			wantPhase: PhaseReload,
+			wantFirst: "old first",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			first := path.Join(dir, "first")
+			other := path.Join(dir, "other")
+			require.NoError(t, os.WriteFile(first, []byte("old first"), 0600))
+
+			tx := NewTransaction(dir)
+			err := stage(tx, first, "new first", validatorFunc(noop), reloaderFunc(noop))
+			require.NoError(t, err)
+
+			err = stage(tx, other, "new other", validatorFunc(tt.validate), reloaderFunc(tt.reload))
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Discard()
+			}
+
+			if tt.wantErr {
+				require.Error(t, err)
+				errs := ApplyErrors(err)
+				require.NotEmpty(t, errs)
+				assert.Equal(t, tt.wantPhase, errs[0].Phase)
+				assert.Equal(t, other, errs[0].Artifact)
+			} else {
+				require.NoError(t, err)
+			}
+
+			content, err := os.ReadFile(first)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFirst, string(content))
+
+			content, err = os.ReadFile(other)
+			if tt.wantOther == "" {
+				assert.True(t, os.IsNotExist(err), "file %s must not exist", other)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantOther, string(content))
+			}
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, e := range entries {
+				assert.NotContains(t, e.Name(), "tmp", "temporary files must be cleaned up")
+			}
+		})
+	}
+}
+
+func stage(tx *Transaction, dest, content string, v Validator, r Reloader) error {
+	tpl := template.Must(template.New(dest).Parse(content))
+	tmp, err := tx.TmpFile("tmp_")
+	if err != nil {
+		return err
+	}
+
+	return tx.Stage(NewNetworkApplier(nil, v, r), *tpl, tmp, dest, 0600, true)
+}
+
+func TestTransaction_Plan(t *testing.T) {
+	dir := t.TempDir()
+	unchanged := path.Join(dir, "unchanged")
+	changed := path.Join(dir, "changed")
+	require.NoError(t, os.WriteFile(unchanged, []byte("same\n"), 0600))
+	require.NoError(t, os.WriteFile(changed, []byte("old\n"), 0600))
+
+	noop := func() error { return nil }
+	tx := NewTransaction(dir)
+	require.NoError(t, stage(tx, unchanged, "same\n", validatorFunc(noop), reloaderFunc(noop)))
+	require.NoError(t, stage(tx, changed, "new\n", validatorFunc(noop), reloaderFunc(noop)))
+
+	diffs, err := tx.Plan()
+	require.NoError(t, err)
+	tx.Discard()
+
+	require.Len(t, diffs, 2)
+	assert.Equal(t, FileDiff{Dest: unchanged}, diffs[0])
+	assert.True(t, diffs[1].Changed)
+	assert.Contains(t, diffs[1].Diff, "-old\n+new\n")
+
+	content, err := os.ReadFile(changed)
+	require.NoError(t, err)
+	assert.Equal(t, "old\n", string(content))
+}
+
+type countingReloader struct {
+	count *int
+}
+
+func (r countingReloader) Reload() error {
+	*r.count++
+	return nil
+}
+
+func TestTransaction_ReloadsEveryServiceOnce(t *testing.T) {
+	dir := t.TempDir()
+	shared, other := 0, 0
+	noop := validatorFunc(func() error { return nil })
+
+	tx := NewTransaction(dir)
+	require.NoError(t, stage(tx, path.Join(dir, "a.network"), "a", noop, countingReloader{count: &shared}))
+	require.NoError(t, stage(tx, path.Join(dir, "b.network"), "b", noop, countingReloader{count: &shared}))
+	require.NoError(t, stage(tx, path.Join(dir, "rules"), "c", noop, countingReloader{count: &other}))
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, 1, shared)
+	assert.Equal(t, 1, other)
+}
+
+type rollbackReloader struct {
+	reloads, rollbacks *int
+}
+
+func (r rollbackReloader) Reload() error {
+	*r.reloads++
+	return nil
+}
+
+func (r rollbackReloader) Rollback() error {
+	*r.rollbacks++
+	return nil
+}
+
+func TestTransaction_RollbackReloader(t *testing.T) {
+	dir := t.TempDir()
+	reloads, rollbacks := 0, 0
+	noop := validatorFunc(func() error { return nil })
+
+	tx := NewTransaction(dir)
+	require.NoError(t, stage(tx, path.Join(dir, "rules"), "rules", noop, rollbackReloader{reloads: &reloads, rollbacks: &rollbacks}))
+	require.NoError(t, stage(tx, path.Join(dir, "other"), "other", noop, reloaderFunc(func() error { return errors.New("failed") })))
+	require.Error(t, tx.Commit())
+
+	// the rejected state is not reloaded again, the restored file is loaded by the rollback
+	assert.Equal(t, 1, reloads)
+	assert.Equal(t, 1, rollbacks)
+}
+
+func TestTransaction_Artifacts(t *testing.T) {
+	dir := t.TempDir()
+	unchanged := path.Join(dir, "unchanged")
+	changed := path.Join(dir, "changed")
+	invalid := path.Join(dir, "invalid")
+	require.NoError(t, os.WriteFile(unchanged, []byte("same"), 0600))
+
+	noop := func() error { return nil }
+	tx := NewTransaction(dir)
+	require.NoError(t, stage(tx, unchanged, "same", validatorFunc(noop), reloaderFunc(noop)))
+	require.NoError(t, stage(tx, changed, "new", validatorFunc(noop), reloaderFunc(noop)))
+	require.Error(t, stage(tx, invalid, "invalid", validatorFunc(func() error { return errors.New("invalid") }), nil))
+	require.NoError(t, tx.Commit())
+
+	artifacts := tx.Artifacts()
+	require.Len(t, artifacts, 3)
+
+	assert.Equal(t, unchanged, artifacts[0].Dest)
+	assert.Equal(t, "net.validatorFunc", artifacts[0].Validator)
+	assert.Equal(t, sha256Hex("same"), artifacts[0].SHA256Before)
+	assert.Equal(t, sha256Hex("same"), artifacts[0].SHA256After)
+	assert.False(t, artifacts[0].Changed)
+	assert.False(t, artifacts[0].Reloaded)
+	assert.Nil(t, artifacts[0].Err)
+
+	assert.Equal(t, changed, artifacts[1].Dest)
+	assert.Empty(t, artifacts[1].SHA256Before)
+	assert.Equal(t, sha256Hex("new"), artifacts[1].SHA256After)
+	assert.True(t, artifacts[1].Changed)
+	assert.True(t, artifacts[1].Reloaded)
+	assert.Nil(t, artifacts[1].Err)
+
+	assert.Equal(t, invalid, artifacts[2].Dest)
+	assert.False(t, artifacts[2].Changed)
+	require.NotNil(t, artifacts[2].Err)
+	assert.Equal(t, PhaseValidate, artifacts[2].Err.Phase)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,138 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// uplinkModeIndependent establishes a BGP unnumbered session at every lan interface.
+	uplinkModeIndependent = "independent"
+	// uplinkModeLACP bonds the lan interfaces with LACP and establishes a single BGP unnumbered session at the bond.
+	uplinkModeLACP = "lacp"
+	// bondName is the name of the bond of the lan interfaces.
+	bondName = "bond0"
+)
+
+type (
+	// uplinkConfig selects how the machine is connected to its leaf switches.
+	uplinkConfig struct {
+		// Mode is either independent or lacp, independent is used if empty. lacp is meant for machines connected to
+		// MLAG leaf pairs.
+		Mode string `yaml:"mode"`
+		// LACP tunes the bond of the lacp mode.
+		LACP lacpConfig `yaml:"lacp"`
+	}
+
+	// lacpConfig contains the LACP parameters of the bond.
+	lacpConfig struct {
+		// TransmitRate is the rate LACPDUs are sent at, either slow or fast. fast is used if empty.
+		TransmitRate string `yaml:"transmit_rate"`
+		// TransmitHashPolicy selects the member a packet is sent through, layer3+4 is used if empty.
+		TransmitHashPolicy string `yaml:"transmit_hash_policy"`
+		// MIIMonitorSec is the interval the link state of the members is checked at like 100ms, 100ms is used if empty.
+		MIIMonitorSec string `yaml:"mii_monitor_sec"`
+		// MinLinks is the minimum number of members that must be up for the bond to be up.
+		MinLinks int `yaml:"min_links"`
+	}
+
+	// BondData contains attributes required to render the systemd.netdev and systemd.network files of the bond.
+	BondData struct {
+		Comment            string
+		Name               string
+		MTU                int
+		TransmitRate       string
+		TransmitHashPolicy string
+		MIIMonitorSec      string
+		MinLinks           int
+	}
+)
+
+// validate checks that the mode is known and that the LACP parameters are supported by systemd-networkd. Bonding is
+// only supported for machines, the lan interfaces of firewalls carry the VXLAN interfaces.
+func (u uplinkConfig) validate(kind BareMetalType, nics int) error {
+	switch u.Mode {
+	case "", uplinkModeIndependent:
+		return nil
+	case uplinkModeLACP:
+	default:
+		return fmt.Errorf("unsupported uplink mode %q", u.Mode)
+	}
+
+	if kind != Machine {
+		return errors.New("uplink mode lacp is only supported for machines")
+	}
+
+	return u.LACP.validate(nics)
+}
+
+func (l lacpConfig) validate(nics int) error {
+	switch l.TransmitRate {
+	case "", "slow", "fast":
+	default:
+		return fmt.Errorf("unsupported lacp transmit rate %q", l.TransmitRate)
+	}
+
+	switch l.TransmitHashPolicy {
+	case "", "layer2", "layer3+4", "layer2+3", "encap2+3", "encap3+4", "vlan+srcmac":
+	default:
+		return fmt.Errorf("unsupported lacp transmit hash policy %q", l.TransmitHashPolicy)
+	}
+
+	if l.MIIMonitorSec != "" {
+		if d, err := time.ParseDuration(l.MIIMonitorSec); err != nil || d <= 0 {
+			return fmt.Errorf("invalid lacp mii monitor interval %q", l.MIIMonitorSec)
+		}
+	}
+
+	if l.MinLinks < 0 || l.MinLinks > nics {
+		return fmt.Errorf("lacp min links %d must be between 0 and the number of nics %d", l.MinLinks, nics)
+	}
+
+	return nil
+}
+
+// bonded returns true if the lan interfaces are bonded.
+func (u uplinkConfig) bonded() bool {
+	return u.Mode == uplinkModeLACP
+}
+
+// getUplinkInterfaces returns the names of the interfaces BGP unnumbered sessions are established at.
+func (c config) getUplinkInterfaces() []string {
+	if c.Networker.Uplinks.bonded() {
+		return []string{bondName}
+	}
+
+	return c.getLANInterfaces()
+}
+
+// getBondData returns the data to render the bond of the lan interfaces, the bond has the MTU of its members.
+func getBondData(kind BareMetalType, c config) (BondData, error) {
+	mtu, err := getMTU(kind)
+	if err != nil {
+		return BondData{}, err
+	}
+
+	l := c.Networker.Uplinks.LACP
+	d := BondData{
+		Comment:            versionHeader(c.MachineUUID),
+		Name:               bondName,
+		MTU:                mtu,
+		TransmitRate:       l.TransmitRate,
+		TransmitHashPolicy: l.TransmitHashPolicy,
+		MIIMonitorSec:      l.MIIMonitorSec,
+		MinLinks:           l.MinLinks,
+	}
+	if d.TransmitRate == "" {
+		d.TransmitRate = "fast"
+	}
+	if d.TransmitHashPolicy == "" {
+		d.TransmitHashPolicy = "layer3+4"
+	}
+	if d.MIIMonitorSec == "" {
+		d.MIIMonitorSec = "100ms"
+	}
+
+	return d, nil
+}
@@ -0,0 +1,94 @@
+package netconf
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUplinkConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		uplinks uplinkConfig
+		kind    BareMetalType
+		wantErr string
+	}{
+		{
+			name: "default",
+			kind: Firewall,
+		},
+		{
+			name:    "lacp with defaults",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP},
+			kind:    Machine,
+		},
+		{
+			name: "lacp with all parameters",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP, LACP: lacpConfig{
+				TransmitRate: "slow", TransmitHashPolicy: "layer2+3", MIIMonitorSec: "1s", MinLinks: 2,
+			}},
+			kind: Machine,
+		},
+		{
+			name:    "unknown mode",
+			uplinks: uplinkConfig{Mode: "active-backup"},
+			kind:    Machine,
+			wantErr: `unsupported uplink mode "active-backup"`,
+		},
+		{
+			name:    "lacp for firewall",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP},
+			kind:    Firewall,
+			wantErr: "uplink mode lacp is only supported for machines",
+		},
+		{
+			name:    "unknown transmit rate",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP, LACP: lacpConfig{TransmitRate: "medium"}},
+			kind:    Machine,
+			wantErr: `unsupported lacp transmit rate "medium"`,
+		},
+		{
+			name:    "unknown transmit hash policy",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP, LACP: lacpConfig{TransmitHashPolicy: "layer4"}},
+			kind:    Machine,
+			wantErr: `unsupported lacp transmit hash policy "layer4"`,
+		},
+		{
+			name:    "invalid mii monitor interval",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP, LACP: lacpConfig{MIIMonitorSec: "100"}},
+			kind:    Machine,
+			wantErr: `invalid lacp mii monitor interval "100"`,
+		},
+		{
+			name:    "more min links than nics",
+			uplinks: uplinkConfig{Mode: uplinkModeLACP, LACP: lacpConfig{MinLinks: 3}},
+			kind:    Machine,
+			wantErr: "lacp min links 3 must be between 0 and the number of nics 2",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.uplinks.validate(tt.kind, 2)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetUplinkInterfaces(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/machine.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lan0", "lan1"}, kb.getUplinkInterfaces())
+
+	kb, err = New(slog.Default(), "testdata/machine_lacp.yaml")
+	require.NoError(t, err)
+	require.NoError(t, kb.Validate(Machine))
+	assert.Equal(t, []string{bondName}, kb.getUplinkInterfaces())
+}
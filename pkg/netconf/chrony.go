@@ -3,31 +3,28 @@ package netconf
 import (
 	"fmt"
 	"log/slog"
-
-	"github.com/metal-stack/metal-networker/pkg/exec"
 )
 
 // chronyServiceEnabler can enable chrony systemd service for the given VRF.
 type chronyServiceEnabler struct {
 	vrf string
 	log *slog.Logger
+	o   options
 }
 
 // newChronyServiceEnabler constructs a new instance of this type.
-func newChronyServiceEnabler(kb config) (chronyServiceEnabler, error) {
+func newChronyServiceEnabler(kb config, o options) (chronyServiceEnabler, error) {
 	vrf, err := kb.getDefaultRouteVRFName()
 	return chronyServiceEnabler{
 		vrf: vrf,
 		log: kb.log,
+		o:   o,
 	}, err
 }
 
 // Enable enables chrony systemd service for the given VRF to be started after boot.
 func (c chronyServiceEnabler) Enable() error {
-	cmd := fmt.Sprintf("systemctl enable chrony@%s", c.vrf)
-	c.log.Info("enable chrony", "command", cmd)
-
-	return exec.NewVerboseCmd("bash", "-c", cmd).Run()
+	return systemctlEnable(c.log, c.o, fmt.Sprintf("chrony@%s", c.vrf))
 }
 
 func containsDefaultRoute(prefixes []string) bool {
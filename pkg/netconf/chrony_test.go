@@ -32,7 +32,7 @@ func TestChronyServiceEnabler_Enable(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		e, err := newChronyServiceEnabler(tt.kb)
+		e, err := newChronyServiceEnabler(tt.kb, newOptions())
 		if tt.isErrorExpected {
 			require.Error(t, err)
 		} else {
@@ -1,12 +1,14 @@
 package netconf
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path"
-	"text/template"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/metal-stack/metal-networker/pkg/exec"
 	"github.com/metal-stack/metal-networker/pkg/net"
 )
@@ -29,9 +31,6 @@ const (
 	fileModeDefault = 0600
 	// systemdUnitPath is the path where systemd units will be generated.
 	systemdUnitPath = "/etc/systemd/system/"
-)
-
-var (
 	// systemdNetworkPath is the path where systemd-networkd expects its configuration files.
 	systemdNetworkPath = "/etc/systemd/network"
 	// tmpPath is the path where temporary files are stored for validation before they are moved to their intended place.
@@ -52,18 +51,21 @@ const (
 type (
 	// Configurator is an interface to configure bare metal servers.
 	Configurator interface {
-		Configure(forwardPolicy ForwardPolicy)
-		ConfigureNftables(forwardPolicy ForwardPolicy)
+		Configure(forwardPolicy ForwardPolicy) error
+		ConfigureNftables(forwardPolicy ForwardPolicy) error
+		Plan(forwardPolicy ForwardPolicy) ([]net.FileDiff, error)
 	}
 
 	// machineConfigurator is a configurator that configures a bare metal server as 'machine'.
 	machineConfigurator struct {
 		c config
+		o options
 	}
 
 	// firewallConfigurator is a configurator that configures a bare metal server as 'firewall'.
 	firewallConfigurator struct {
 		c              config
+		o              options
 		enableDNSProxy bool
 	}
 )
@@ -76,16 +78,20 @@ type unitConfiguration struct {
 }
 
 // NewConfigurator creates a new configurator.
-func NewConfigurator(kind BareMetalType, c config, enableDNS bool) (Configurator, error) {
+func NewConfigurator(kind BareMetalType, c config, enableDNS bool, opts ...Option) (Configurator, error) {
+	o := newOptions(opts...)
+
 	switch kind {
 	case Firewall:
 		return firewallConfigurator{
 			c:              c,
+			o:              o,
 			enableDNSProxy: enableDNS,
 		}, nil
 	case Machine:
 		return machineConfigurator{
 			c: c,
+			o: o,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown type:%d", kind)
@@ -93,73 +99,192 @@ func NewConfigurator(kind BareMetalType, c config, enableDNS bool) (Configurator
 }
 
 // Configure applies configuration to a bare metal server to function as 'machine'.
-func (mc machineConfigurator) Configure(forwardPolicy ForwardPolicy) {
-	applyCommonConfiguration(mc.c.log, Machine, mc.c)
+func (mc machineConfigurator) Configure(forwardPolicy ForwardPolicy) error {
+	started := time.Now()
+	artifacts, err := commit(mc.o, func(tx *net.Transaction) error {
+		return applyCommonConfiguration(mc.c.log, Machine, mc.c, mc.o, tx)
+	})
+
+	return finish(mc.c, mc.o, started, artifacts, nil, err)
 }
 
 // ConfigureNftables is empty function that exists just to satisfy the Configurator interface
-func (mc machineConfigurator) ConfigureNftables(forwardPolicy ForwardPolicy) {}
+func (mc machineConfigurator) ConfigureNftables(forwardPolicy ForwardPolicy) error {
+	return nil
+}
+
+// Plan renders and validates the configuration of a 'machine' and returns the pending changes without applying them.
+func (mc machineConfigurator) Plan(forwardPolicy ForwardPolicy) ([]net.FileDiff, error) {
+	return plan(mc.o, func(tx *net.Transaction) error {
+		return applyCommonConfiguration(mc.c.log, Machine, mc.c, mc.o, tx)
+	})
+}
 
 // Configure applies configuration to a bare metal server to function as 'firewall'.
-func (fc firewallConfigurator) Configure(forwardPolicy ForwardPolicy) {
-	kb := fc.c
-	applyCommonConfiguration(fc.c.log, Firewall, kb)
+func (fc firewallConfigurator) Configure(forwardPolicy ForwardPolicy) error {
+	started := time.Now()
+	artifacts, err := commit(fc.o, func(tx *net.Transaction) error {
+		return fc.stage(tx, forwardPolicy)
+	})
+	if err != nil {
+		return finish(fc.c, fc.o, started, artifacts, nil, err)
+	}
 
-	fc.ConfigureNftables(forwardPolicy)
+	var (
+		errs  []error
+		units []ReportUnit
+	)
 
-	chrony, err := newChronyServiceEnabler(fc.c)
+	chrony, err := newChronyServiceEnabler(fc.c, fc.o)
 	if err != nil {
 		fc.c.log.Warn("failed to configure chrony", "error", err)
 	} else {
+		unit := "chrony@" + chrony.vrf
 		err := chrony.Enable()
 		if err != nil {
-			fc.c.log.Error("enabling chrony failed", "error", err)
+			err = &net.ApplyError{Artifact: unit, Phase: net.PhaseEnable, Err: err}
+			errs = append(errs, err)
 		}
+		units = append(units, newReportUnit(unit, err))
+	}
+
+	for _, u := range fc.getUnits() {
+		if u.enabled {
+			err := enableUnit(fc.c.log, fc.o, u.unit)
+			errs = append(errs, err)
+			units = append(units, newReportUnit(u.unit, err))
+		}
+	}
+
+	return finish(fc.c, fc.o, started, artifacts, units, errors.Join(errs...))
+}
+
+// ConfigureNftables applies the nftables configuration to a bare metal server to function as 'firewall'.
+func (fc firewallConfigurator) ConfigureNftables(forwardPolicy ForwardPolicy) error {
+	started := time.Now()
+	artifacts, err := commit(fc.o, func(tx *net.Transaction) error {
+		return fc.stageNftables(tx, forwardPolicy)
+	})
+
+	return finish(fc.c, fc.o, started, artifacts, nil, err)
+}
+
+// Plan renders and validates the configuration of a 'firewall' and returns the pending changes without applying them.
+func (fc firewallConfigurator) Plan(forwardPolicy ForwardPolicy) ([]net.FileDiff, error) {
+	return plan(fc.o, func(tx *net.Transaction) error {
+		return fc.stage(tx, forwardPolicy)
+	})
+}
+
+// stage renders and validates all artifacts of a 'firewall' into the given transaction.
+// All artifacts are staged even if some of them fail, the returned error joins the errors of all failed artifacts.
+func (fc firewallConfigurator) stage(tx *net.Transaction, forwardPolicy ForwardPolicy) error {
+	kb := fc.c
+	errs := []error{
+		applyCommonConfiguration(fc.c.log, Firewall, kb, fc.o, tx),
+		fc.stageNftables(tx, forwardPolicy),
 	}
 
 	for _, u := range fc.getUnits() {
-		src := mustTmpFile(u.unit)
+		dest := fc.o.path(path.Join(systemdUnitPath, u.unit))
+		src, err := tmpFile(tx, u.unit, dest)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
 		validatorService := serviceValidator{src}
 		nfe, err := u.constructApplier(fc.c, validatorService)
-
 		if err != nil {
 			fc.c.log.Warn("failed to deploy", "unit", u.unit, "error", err)
+			_ = os.Remove(src)
+			continue
 		}
 
-		applyAndCleanUp(fc.c.log, nfe, u.templateFile, src, path.Join(systemdUnitPath, u.unit), fileModeSystemd, false)
-
-		if u.enabled {
-			mustEnableUnit(fc.c.log, u.unit)
-		}
+		nfe = net.WithReloader(nfe, net.NewDBusRestarter(u.unit))
+		errs = append(errs, stage(fc.c.log, tx, nfe, u.templateFile, src, dest, fileModeSystemd, fc.o.reloadServices()))
 	}
 
-	src := mustTmpFile("suricata_")
-	applier, err := newSuricataDefaultsApplier(kb, src)
-
+	// the modules are staged first, the keys of the sysctl settings only exist once they are loaded
+	dest := fc.o.path(conntrackModulesPath)
+	src, err := tmpFile(tx, "conntrack_modules_", dest)
 	if err != nil {
-		fc.c.log.Warn("failed to configure suricata defaults", "error", err)
+		errs = append(errs, err)
+	} else {
+		applier := newConntrackModulesApplier(kb, src)
+		errs = append(errs, stage(fc.c.log, tx, applier, tplConntrackModules, src, dest, fileModeSixFourFour, fc.o.reloadServices()))
 	}
 
-	applyAndCleanUp(fc.c.log, applier, tplSuricataDefaults, src, "/etc/default/suricata", fileModeSixFourFour, false)
+	dest = fc.o.path(conntrackSysctlPath)
+	src, err = tmpFile(tx, "conntrack_", dest)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		applier := newConntrackApplier(kb, src)
+		errs = append(errs, stage(fc.c.log, tx, applier, tplConntrack, src, dest, fileModeSixFourFour, fc.o.reloadServices()))
+	}
 
-	src = mustTmpFile("suricata.yaml_")
-	applier, err = newSuricataConfigApplier(kb, src)
+	dest = fc.o.path("/etc/default/suricata")
+	src, err = tmpFile(tx, "suricata_", dest)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		applier, err := newSuricataDefaultsApplier(kb, src)
+		if err != nil {
+			fc.c.log.Warn("failed to configure suricata defaults", "error", err)
+			_ = os.Remove(src)
+		} else {
+			errs = append(errs, stage(fc.c.log, tx, applier, tplSuricataDefaults, src, dest, fileModeSixFourFour, false))
+		}
+	}
 
+	dest = fc.o.path("/etc/suricata/suricata.yaml")
+	src, err = tmpFile(tx, "suricata.yaml_", dest)
 	if err != nil {
-		fc.c.log.Warn("failed to configure suricata", "error", err)
+		errs = append(errs, err)
+	} else {
+		applier, err := newSuricataConfigApplier(kb, src)
+		if err != nil {
+			fc.c.log.Warn("failed to configure suricata", "error", err)
+			_ = os.Remove(src)
+		} else {
+			errs = append(errs, stage(fc.c.log, tx, applier, tplSuricataConfig, src, dest, fileModeSixFourFour, false))
+		}
 	}
 
-	applyAndCleanUp(fc.c.log, applier, tplSuricataConfig, src, "/etc/suricata/suricata.yaml", fileModeSixFourFour, false)
+	return errors.Join(errs...)
 }
 
-func (fc firewallConfigurator) ConfigureNftables(forwardPolicy ForwardPolicy) {
-	src := mustTmpFile("nftrules_")
-	validator := NftablesValidator{
-		path: src,
-		log:  fc.c.log,
+func (fc firewallConfigurator) stageNftables(tx *net.Transaction, forwardPolicy ForwardPolicy) error {
+	dest := fc.o.path("/etc/nftables/rules")
+	src, err := tmpFile(tx, "nftrules_", dest)
+	if err != nil {
+		return err
+	}
+
+	var applier net.Applier
+	if fc.o.nftablesNetlink {
+		var ruleset NftRuleset
+		ruleset, err = newNftablesRuleset(fc.c, fc.enableDNSProxy, forwardPolicy)
+		if err == nil {
+			validator := NftablesNetlinkValidator{ruleset: ruleset, path: src, log: fc.c.log}
+			reloader := NftablesNetlinkReloader{ruleset: ruleset, path: dest, log: fc.c.log}
+			applier = newNftablesRulesetApplier(fc.c, ruleset, validator, reloader)
+		}
+	} else {
+		validator := NftablesValidator{
+			path: src,
+			log:  fc.c.log,
+		}
+		applier, err = newNftablesConfigApplier(fc.c, validator, fc.enableDNSProxy, forwardPolicy)
+	}
+	if err != nil {
+		_ = os.Remove(src)
+		return &net.ApplyError{Artifact: dest, Phase: net.PhaseRender, Err: err}
 	}
-	applier := newNftablesConfigApplier(fc.c, validator, fc.enableDNSProxy, forwardPolicy)
-	applyAndCleanUp(fc.c.log, applier, TplNftables, src, "/etc/nftables/rules", fileModeDefault, true)
+
+	// reloading nftables only makes sense if the rules are applied to the running system
+	return stage(fc.c.log, tx, applier, TplNftables, src, dest, fileModeDefault, fc.o.isHostRoot())
 }
 
 func (fc firewallConfigurator) getUnits() (units []unitConfiguration) {
@@ -227,72 +352,181 @@ func (fc firewallConfigurator) getUnits() (units []unitConfiguration) {
 	return units
 }
 
-func applyCommonConfiguration(log *slog.Logger, kind BareMetalType, kb config) {
-	a := newIfacesApplier(kind, kb)
-	a.Apply()
+// applyCommonConfiguration stages the artifacts that are common to all kinds of bare metal servers.
+func applyCommonConfiguration(log *slog.Logger, kind BareMetalType, kb config, o options, tx *net.Transaction) error {
+	var errs []error
 
-	src := mustTmpFile("hosts_")
-	applier := newHostsApplier(kb, src)
-	applyAndCleanUp(log, applier, tplHosts, src, "/etc/hosts", fileModeDefault, false)
+	a, err := newIfacesApplier(kind, kb, o)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = append(errs, a.Stage(tx))
+	}
 
-	src = mustTmpFile("hostname_")
-	applier = newHostnameApplier(kb, src)
-	applyAndCleanUp(log, applier, tplHostname, src, "/etc/hostname", fileModeSixFourFour, false)
+	dest := o.path("/etc/hosts")
+	src, err := tmpFile(tx, "hosts_", dest)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		applier := newHostsApplier(kb, src)
+		errs = append(errs, stage(log, tx, applier, tplHosts, src, dest, fileModeDefault, false))
+	}
 
-	src = mustTmpFile("frr_")
-	applier = NewFrrConfigApplier(kind, kb, src, nil)
-	tpl := TplFirewallFRR
+	dest = o.path("/etc/hostname")
+	src, err = tmpFile(tx, "hostname_", dest)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		applier := newHostnameApplier(kb, src)
+		errs = append(errs, stage(log, tx, applier, tplHostname, src, dest, fileModeSixFourFour, false))
+	}
+
+	dest = o.path("/etc/frr/frr.conf")
+	src, err = tmpFile(tx, "frr_", dest)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		tpl := TplFirewallFRR
+		if kind == Machine {
+			tpl = TplMachineFRR
+		}
 
-	if kind == Machine {
-		tpl = TplMachineFRR
+		v, err := frrVersion(log, o)
+		var applier net.Applier
+		if err == nil {
+			applier, err = NewFrrConfigApplier(kind, kb, src, v)
+		}
+		if err != nil {
+			_ = os.Remove(src)
+			errs = append(errs, &net.ApplyError{Artifact: dest, Phase: net.PhaseRender, Err: err})
+		} else {
+			errs = append(errs, stage(log, tx, applier, tpl, src, dest, fileModeDefault, o.reloadServices()))
+		}
 	}
 
-	applyAndCleanUp(log, applier, tpl, src, "/etc/frr/frr.conf", fileModeDefault, false)
+	return errors.Join(errs...)
 }
 
-func applyAndCleanUp(log *slog.Logger, applier net.Applier, tpl, src, dest string, mode os.FileMode, reload bool) {
+// frrVersion returns the version of FRR to render frr.conf for. Unless given explicitly, the version installed on the
+// running system is detected. If the version is unknown, nil is returned to render frr.conf for the minimum supported
+// version. A running FRR is not reloaded with a configuration for a version it might not support, so a failed
+// detection is an error if services are reloaded.
+func frrVersion(log *slog.Logger, o options) (*semver.Version, error) {
+	v := o.frrVersion
+	if v == nil && o.isHostRoot() {
+		detected, err := detectFRRVersion(log, o.versionCmd)
+		if err != nil {
+			if o.reloadServices() {
+				return nil, err
+			}
+			log.Warn("rendering frr.conf for the minimum supported frr version", "version", FRRVersion, "error", err)
+			return nil, nil
+		}
+		v = detected
+	}
+
+	if v != nil && v.Major() < MinimumFRRMajorVersion {
+		log.Warn("frr version is not supported", "version", v.String(), "minimum", MinimumFRRMajorVersion)
+	}
+
+	return v, nil
+}
+
+// stage renders and validates the given template into src and stages it to be moved to dest on commit.
+func stage(log *slog.Logger, tx *net.Transaction, applier net.Applier, tpl, src, dest string, mode os.FileMode, reload bool) error {
 	log.Info("rendering", "template", tpl, "destination", dest, "mode", mode)
-	file := mustReadTpl(tpl)
-	mustApply(applier, file, src, dest, reload)
 
-	err := os.Chmod(dest, mode)
+	t, err := parseTpl(tpl)
+	if err != nil {
+		_ = os.Remove(src)
+		return &net.ApplyError{Artifact: dest, Phase: net.PhaseRender, Err: err}
+	}
+
+	return tx.Stage(applier, *t, src, dest, mode, reload)
+}
+
+func enableUnit(log *slog.Logger, o options, unit string) error {
+	err := systemctlEnable(log, o, unit)
 	if err != nil {
-		log.Error("unable change mode", "file", dest, "mode", mode, "error", err)
+		return &net.ApplyError{Artifact: unit, Phase: net.PhaseEnable, Err: err}
 	}
 
-	_ = os.Remove(src)
+	return nil
 }
 
-func mustEnableUnit(log *slog.Logger, unit string) {
+// systemctlEnable enables the given unit, units below a root other than "/" are enabled offline with --root.
+func systemctlEnable(log *slog.Logger, o options, unit string) error {
 	cmd := fmt.Sprintf("systemctl enable %s", unit)
+	if !o.isHostRoot() {
+		cmd = fmt.Sprintf("systemctl --root=%s enable %s", o.root, unit)
+	}
 	log.Info("enable unit", "command", cmd)
 
-	err := exec.NewVerboseCmd("bash", "-c", cmd).Run()
+	return exec.NewVerboseCmd("bash", "-c", cmd).Run()
+}
 
+// tmpFile creates a temporary file in the staging directory of the transaction for the given destination.
+func tmpFile(tx *net.Transaction, prefix, dest string) (string, error) {
+	f, err := tx.TmpFile(prefix)
 	if err != nil {
-		panic(err)
+		return "", &net.ApplyError{Artifact: dest, Phase: net.PhaseRender, Err: err}
 	}
+
+	return f, nil
 }
 
-func mustApply(applier net.Applier, tpl, src, dest string, reload bool) {
-	t := template.Must(template.New(src).Parse(tpl))
-	_, err := applier.Apply(*t, src, dest, reload)
+// commit stages all artifacts with the given function into a transaction and commits it.
+// Nothing is applied if staging any of the artifacts fails. The returned artifacts describe how every artifact was
+// handled.
+func commit(o options, stage func(tx *net.Transaction) error) ([]net.Artifact, error) {
+	dir := o.path(tmpPath)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := net.NewTransaction(dir)
 
+	err = stageAndCheck(o, tx, stage)
 	if err != nil {
-		panic(err)
+		tx.Discard()
+		return tx.Artifacts(), err
 	}
+
+	err = tx.Commit()
+
+	return tx.Artifacts(), err
 }
 
-func mustTmpFile(prefix string) string {
-	f, err := os.CreateTemp(tmpPath, prefix)
+// plan stages all artifacts with the given function into a temporary directory and returns the pending changes.
+// Neither the destination files nor the staging directory of the networker are touched.
+func plan(o options, stage func(tx *net.Transaction) error) ([]net.FileDiff, error) {
+	dir, err := os.MkdirTemp("", "metal-networker-plan-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	tx := net.NewTransaction(dir)
+	defer tx.Discard()
+
+	err = stageAndCheck(o, tx, stage)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = f.Close()
+	return tx.Plan()
+}
+
+// stageAndCheck stages all artifacts with the given function and checks the consistency of the staged artifacts.
+func stageAndCheck(o options, tx *net.Transaction, stage func(tx *net.Transaction) error) error {
+	err := stage(tx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	return f.Name()
+	return checkConsistency(o, tx.Staged())
 }
@@ -0,0 +1,283 @@
+package netconf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+const (
+	// tplConntrack is the name of the template to render the conntrack sysctl settings.
+	tplConntrack = "conntrack.sysctl.tpl"
+	// tplConntrackModules is the name of the template to render the kernel modules required by the sysctl settings.
+	tplConntrackModules = "conntrack.modules.tpl"
+	// systemdUnitSysctl applies the sysctl settings of /etc/sysctl.d.
+	systemdUnitSysctl = "systemd-sysctl.service"
+	// systemdUnitModulesLoad loads the kernel modules of /etc/modules-load.d, it runs before systemd-sysctl.service.
+	systemdUnitModulesLoad = "systemd-modules-load.service"
+	// conntrackSysctlPath is the location of the conntrack sysctl settings.
+	conntrackSysctlPath = "/etc/sysctl.d/90-metal-networker-conntrack.conf"
+	// conntrackModulesPath is the location of the kernel modules required by the conntrack sysctl settings. The keys
+	// of the settings only exist once nf_conntrack is loaded, without loading it on boot they would be skipped.
+	conntrackModulesPath = "/etc/modules-load.d/metal-networker-conntrack.conf"
+	// conntrackSysctlPrefix is the prefix of all keys of the conntrack sysctl settings.
+	conntrackSysctlPrefix = "net.netfilter.nf_conntrack_"
+)
+
+type (
+	// conntrackConfig tunes the connection tracking of the firewall.
+	conntrackConfig struct {
+		// Max is the maximum number of tracked connections, the kernel default is used if zero.
+		Max uint32 `yaml:"max"`
+		// TCPTimeoutEstablished is the timeout of established tcp connections in seconds.
+		TCPTimeoutEstablished uint32 `yaml:"tcp_timeout_established"`
+		// UDPTimeout is the timeout of udp flows that have not seen traffic in both directions in seconds.
+		UDPTimeout uint32 `yaml:"udp_timeout"`
+		// UDPTimeoutStream is the timeout of udp flows that have seen traffic in both directions in seconds.
+		UDPTimeoutStream uint32 `yaml:"udp_timeout_stream"`
+		// Zones are services of the firewall whose connections from the tenant networks are tracked in the
+		// conntrack zone of the VRF they come from.
+		Zones []conntrackZoneService `yaml:"zones"`
+	}
+
+	// conntrackZoneService is a service of the firewall reached from the tenant networks.
+	conntrackZoneService struct {
+		// Protocols are tcp or udp, tcp is used if empty.
+		Protocols []string `yaml:"protocols"`
+		// Ports are the ports of the service.
+		Ports []string `yaml:"ports"`
+	}
+
+	// conntrackZone assigns the connections of services reached through the SVI of a tenant network to the zone of its
+	// VRF. The traffic of these services leaks from the VRF of the tenant into the VRF of the firewall, which makes
+	// conntrack register duplicate entries if it is tracked in the same zone as the traffic of other VRFs.
+	conntrackZone struct {
+		Interface string
+		Zone      int
+		Services  []conntrackZoneService
+	}
+
+	// ConntrackData represents the information required to render the conntrack sysctl settings.
+	ConntrackData struct {
+		Comment string
+		Sysctls []Sysctl
+	}
+
+	// Sysctl is a single kernel parameter.
+	Sysctl struct {
+		Key   string
+		Value string
+	}
+
+	// conntrackValidator validates the conntrack sysctl settings.
+	conntrackValidator struct {
+		path string
+	}
+
+	// conntrackModulesValidator validates the kernel modules to load.
+	conntrackModulesValidator struct {
+		path string
+	}
+)
+
+// kernelModuleName matches the name of a kernel module.
+var kernelModuleName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// validate checks that the zone services can be expressed by nftables rules.
+func (ct conntrackConfig) validate() error {
+	var errs []error
+	for i, s := range ct.Zones {
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("conntrack zone %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s conntrackZoneService) validate() error {
+	for _, p := range s.Protocols {
+		protocol := firewallRule{Protocol: p}.protocol()
+		if protocol != protocolTCP && protocol != protocolUDP {
+			return fmt.Errorf("unsupported protocol %q", p)
+		}
+	}
+
+	if len(s.Ports) == 0 {
+		return errors.New("no ports given")
+	}
+	for _, p := range s.Ports {
+		if _, err := parsePortRange(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// protocols returns the protocols of the service in lower case, tcp if none are given.
+func (s conntrackZoneService) protocols() []string {
+	if len(s.Protocols) == 0 {
+		return []string{protocolTCP}
+	}
+
+	var result []string
+	for _, p := range s.Protocols {
+		result = append(result, firewallRule{Protocol: p}.protocol())
+	}
+
+	return result
+}
+
+// sysctls returns the kernel parameters of the settings that are given.
+func (ct conntrackConfig) sysctls() []Sysctl {
+	var result []Sysctl
+	for _, s := range []struct {
+		key   string
+		value uint32
+	}{
+		{conntrackSysctlPrefix + "max", ct.Max},
+		{conntrackSysctlPrefix + "tcp_timeout_established", ct.TCPTimeoutEstablished},
+		{conntrackSysctlPrefix + "udp_timeout", ct.UDPTimeout},
+		{conntrackSysctlPrefix + "udp_timeout_stream", ct.UDPTimeoutStream},
+	} {
+		if s.value > 0 {
+			result = append(result, Sysctl{Key: s.key, Value: strconv.FormatUint(uint64(s.value), 10)})
+		}
+	}
+
+	return result
+}
+
+// getConntrackZones returns the conntrack zones of the tenant networks. Every VRF gets its own zone, the VLAN id of its
+// SVI is used as zone number. The DNS proxy is a service of every VRF it is reachable from.
+func getConntrackZones(c config, dnat DNAT) []conntrackZone {
+	zones := map[int]int{}
+	for _, e := range getEVPNIfaces(c) {
+		zones[e.VRF.ID] = e.SVI.VLANID
+	}
+
+	var result []conntrackZone
+	for _, n := range c.GetNetworks(mn.PrivatePrimaryUnshared, mn.PrivatePrimaryShared, mn.PrivateSecondaryShared) {
+		zone, ok := zones[int(*n.Vrf)]
+		if !ok {
+			continue
+		}
+
+		svi := fmt.Sprintf("vlan%d", *n.Vrf)
+		services := c.Networker.Conntrack.Zones
+		for _, iface := range dnat.InInterfaces {
+			if iface == svi {
+				services = append([]conntrackZoneService{{Protocols: protocols, Ports: []string{dnat.Port}}}, services...)
+			}
+		}
+		if len(services) == 0 {
+			continue
+		}
+
+		result = append(result, conntrackZone{Interface: svi, Zone: zone, Services: services})
+	}
+
+	return result
+}
+
+// rules returns the rules assigning the connections of the services to the zone. ifname and port select the direction
+// of the traffic: iifname and dport for requests, oifname and sport for responses.
+func (z conntrackZone) rules(ifname, port string) []NftRule {
+	var result []NftRule
+
+	for _, s := range z.Services {
+		for _, proto := range s.protocols() {
+			result = append(result, NftRule{
+				Matches:    []NftMatch{nftIfname(ifname, z.Interface), nftMatch(proto+" "+port, s.Ports...)},
+				Statements: []NftStatement{NftCTZone{Zone: strconv.Itoa(z.Zone)}},
+			})
+		}
+	}
+
+	return result
+}
+
+// newConntrackApplier constructs an applier for the conntrack sysctl settings.
+func newConntrackApplier(kb config, tmpFile string) net.Applier {
+	data := ConntrackData{Comment: versionHeader(kb.MachineUUID), Sysctls: kb.Networker.Conntrack.sysctls()}
+	validator := conntrackValidator{path: tmpFile}
+
+	return net.NewNetworkApplier(data, validator, net.NewDBusRestarter(systemdUnitSysctl))
+}
+
+// newConntrackModulesApplier constructs an applier for the kernel modules required by the conntrack sysctl settings.
+// systemd-modules-load.service is restarted to load them right away, systemd-sysctl.service is ordered after it on
+// boot.
+func newConntrackModulesApplier(kb config, tmpFile string) net.Applier {
+	data := ConntrackData{Comment: versionHeader(kb.MachineUUID)}
+	validator := conntrackModulesValidator{path: tmpFile}
+
+	return net.NewNetworkApplier(data, validator, net.NewDBusRestarter(systemdUnitModulesLoad))
+}
+
+// Validate checks that every line of the sysctl settings assigns a value to a conntrack key.
+func (v conntrackValidator) Validate() error {
+	return validateLines(v.path, func(line string) error {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" || strings.TrimSpace(value) == "" {
+			return fmt.Errorf("%q is not a sysctl setting", line)
+		}
+		if !strings.HasPrefix(strings.TrimSpace(key), conntrackSysctlPrefix) {
+			return fmt.Errorf("%q is not a conntrack sysctl setting", strings.TrimSpace(key))
+		}
+
+		return nil
+	})
+}
+
+// Validate checks that every line names a kernel module.
+func (v conntrackModulesValidator) Validate() error {
+	return validateLines(v.path, func(line string) error {
+		if !kernelModuleName.MatchString(line) {
+			return fmt.Errorf("%q is not a kernel module", line)
+		}
+
+		return nil
+	})
+}
+
+// validateLines validates every line of the given file that is neither empty nor a comment. All problems found are
+// returned joined.
+func validateLines(path string, validate func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var errs []error
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := validate(line); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package netconf
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConntrackApplier(t *testing.T) {
+	expected, err := os.ReadFile("testdata/conntrack.sysctl")
+	require.NoError(t, err)
+
+	kb, err := New(slog.Default(), "testdata/firewall_conntrack.yaml")
+	require.NoError(t, err)
+	a := newConntrackApplier(*kb, "")
+	b := bytes.Buffer{}
+
+	tpl := MustParseTpl(tplConntrack)
+	err = a.Render(&b, *tpl)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), b.String())
+}
+
+func TestConntrackValidator(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := path.Join(dir, "valid")
+	require.NoError(t, os.WriteFile(valid, []byte("# comment\n\nnet.netfilter.nf_conntrack_max = 1048576\n"), 0o600))
+	require.NoError(t, conntrackValidator{path: valid}.Validate())
+
+	invalid := path.Join(dir, "invalid")
+	require.NoError(t, os.WriteFile(invalid, []byte("net.netfilter.nf_conntrack_max\n"), 0o600))
+	require.EqualError(t, conntrackValidator{path: invalid}.Validate(),
+		`line 1: "net.netfilter.nf_conntrack_max" is not a sysctl setting`)
+
+	foreign := path.Join(dir, "foreign")
+	require.NoError(t, os.WriteFile(foreign, []byte("net.ipv4.ip_forward = 1\n"), 0o600))
+	require.EqualError(t, conntrackValidator{path: foreign}.Validate(),
+		`line 1: "net.ipv4.ip_forward" is not a conntrack sysctl setting`)
+}
+
+func TestNewConntrackModulesApplier(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall_conntrack.yaml")
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	modules := path.Join(dir, "modules")
+	a := newConntrackModulesApplier(*kb, modules)
+	b := bytes.Buffer{}
+
+	tpl := MustParseTpl(tplConntrackModules)
+	err = a.Render(&b, *tpl)
+	require.NoError(t, err)
+	assert.Equal(t, versionHeader(kb.MachineUUID)+"\nnf_conntrack\n", b.String())
+
+	require.NoError(t, os.WriteFile(modules, b.Bytes(), 0o600))
+	require.NoError(t, conntrackModulesValidator{path: modules}.Validate())
+
+	require.NoError(t, os.WriteFile(modules, []byte("nf_conntrack ipv6\n"), 0o600))
+	require.EqualError(t, conntrackModulesValidator{path: modules}.Validate(), `line 1: "nf_conntrack ipv6" is not a kernel module`)
+}
+
+func TestConntrackZoneService_Validate(t *testing.T) {
+	require.NoError(t, conntrackZoneService{Protocols: []string{"UDP"}, Ports: []string{"53", "9000-9010"}}.validate())
+	require.EqualError(t, conntrackZoneService{Protocols: []string{"icmp"}, Ports: []string{"53"}}.validate(),
+		`unsupported protocol "icmp"`)
+	require.EqualError(t, conntrackZoneService{}.validate(), "no ports given")
+
+	c := conntrackConfig{Zones: []conntrackZoneService{{Ports: []string{"8080"}}, {Ports: []string{"0"}}}}
+	require.EqualError(t, c.validate(), `conntrack zone 1: invalid port "0"`)
+}
+
+func TestGetConntrackZones(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	assert.Empty(t, getConntrackZones(*kb, DNAT{}))
+
+	zones := getConntrackZones(*kb, getDNSProxyDNAT(*kb, dnsPort))
+	require.Len(t, zones, 2)
+	assert.Equal(t, "vlan3981", zones[0].Interface)
+	assert.Equal(t, 1000, zones[0].Zone)
+	assert.Equal(t, "vlan3982", zones[1].Interface)
+	assert.Equal(t, 1001, zones[1].Zone)
+}
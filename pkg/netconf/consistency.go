@@ -0,0 +1,222 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+var (
+	// frrVRFReference matches all places frr.conf refers to a VRF by its name.
+	frrVRFReference = regexp.MustCompile(`(?m)^\s*(?:vrf|router bgp \d+ vrf|import vrf|match source-vrf)\s+(\S+)\s*$`)
+	// frrInterfaceReference matches all places frr.conf refers to an interface by its name.
+	frrInterfaceReference = regexp.MustCompile(`(?m)^\s*(?:interface\s+(\S+)|neighbor\s+(\S+)\s+interface\b.*)$`)
+	// frrVNIReference matches all VNIs frr.conf binds to a VRF.
+	frrVNIReference = regexp.MustCompile(`(?m)^\s*vni\s+(\d+)\s*$`)
+	// nftInterfaceReference matches interface names and sets of interface names of iifname and oifname expressions.
+	nftInterfaceReference = regexp.MustCompile(`\b[io]ifname\s+(?:!=\s*)?(\{[^}]*\}|"[^"]*")`)
+	// quoted matches a quoted string.
+	quoted = regexp.MustCompile(`"([^"]*)"`)
+)
+
+// networkdDefinitions holds the interfaces defined by systemd-networkd files.
+type networkdDefinitions struct {
+	// interfaces maps the name of every defined interface to its kind.
+	interfaces map[string]string
+	// tables maps the routing table of every VRF to the file defining it.
+	tables map[string]string
+	// vnis maps the VNI of every VXLAN to the file defining it.
+	vnis map[string]string
+}
+
+// checkConsistency verifies that all VRFs, interfaces and VNIs referenced by the staged frr.conf and nftables rules
+// are defined by systemd-networkd files and that routing tables of VRFs and VNIs are unique.
+// Staged systemd-networkd files take precedence over the ones already present at the destination.
+func checkConsistency(o options, staged map[string]string) error {
+	networkPath := o.path(systemdNetworkPath)
+
+	files := map[string]string{}
+	entries, err := os.ReadDir(networkPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			files[filepath.Join(networkPath, e.Name())] = filepath.Join(networkPath, e.Name())
+		}
+	}
+	for dest, src := range staged {
+		if filepath.Dir(dest) == filepath.Clean(networkPath) {
+			files[dest] = src
+		}
+	}
+
+	defs, errs := parseNetworkdDefinitions(files)
+
+	frr := o.path("/etc/frr/frr.conf")
+	if src, ok := staged[frr]; ok {
+		errs = append(errs, checkReferences(frr, src, defs, frrReferences))
+	}
+
+	nftables := o.path("/etc/nftables/rules")
+	if src, ok := staged[nftables]; ok {
+		errs = append(errs, checkReferences(nftables, src, defs, nftReferences))
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseNetworkdDefinitions collects the interfaces defined by the given systemd-networkd files, which are given by
+// their destination and their current location.
+func parseNetworkdDefinitions(files map[string]string) (networkdDefinitions, []error) {
+	defs := networkdDefinitions{
+		interfaces: map[string]string{"lo": "loopback"},
+		tables:     map[string]string{},
+		vnis:       map[string]string{},
+	}
+
+	var errs []error
+
+	// sorted to report conflicts deterministically
+	for _, dest := range slices.Sorted(maps.Keys(files)) {
+		ext := filepath.Ext(dest)
+		if ext != ".netdev" && ext != ".link" {
+			continue
+		}
+
+		content, err := os.ReadFile(files[dest])
+		if err != nil {
+			errs = append(errs, &net.ApplyError{Artifact: dest, Phase: net.PhaseValidate, Err: err})
+			continue
+		}
+
+		sections, err := parseUnitFile(content)
+		if err != nil {
+			errs = append(errs, &net.ApplyError{Artifact: dest, Phase: net.PhaseValidate, Err: err})
+			continue
+		}
+
+		if ext == ".link" {
+			if name := unitValue(sections, "Link", "Name"); name != "" {
+				defs.interfaces[name] = "link"
+			}
+			continue
+		}
+
+		name := unitValue(sections, "NetDev", "Name")
+		kind := unitValue(sections, "NetDev", "Kind")
+		if name == "" {
+			continue
+		}
+		defs.interfaces[name] = kind
+
+		unique := func(values map[string]string, value, what string) {
+			if value == "" {
+				return
+			}
+			if other, ok := values[value]; ok {
+				err := fmt.Errorf("%s %s of %s is already used by %s", what, value, name, other)
+				errs = append(errs, &net.ApplyError{Artifact: dest, Phase: net.PhaseValidate, Err: err})
+				return
+			}
+			values[value] = dest
+		}
+
+		switch kind {
+		case "vrf":
+			unique(defs.tables, unitValue(sections, "VRF", "Table"), "routing table")
+		case "vxlan":
+			unique(defs.vnis, unitValue(sections, "VXLAN", "VNI"), "VNI")
+		}
+	}
+
+	return defs, errs
+}
+
+// reference is a VRF, interface or VNI referenced by an artifact.
+type reference struct {
+	kind string
+	name string
+}
+
+// checkReferences checks that every reference found by the given function in the file at src, which is going to be
+// written to dest, is defined.
+func checkReferences(dest, src string, defs networkdDefinitions, references func(string) []reference) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return &net.ApplyError{Artifact: dest, Phase: net.PhaseValidate, Err: err}
+	}
+
+	var (
+		errs     []error
+		reported = map[reference]bool{}
+	)
+
+	for _, r := range references(string(content)) {
+		if reported[r] {
+			continue
+		}
+
+		var defined bool
+		switch r.kind {
+		case "vrf":
+			defined = defs.interfaces[r.name] == "vrf"
+		case "vni":
+			_, defined = defs.vnis[r.name]
+		default:
+			_, defined = defs.interfaces[r.name]
+		}
+
+		if !defined {
+			reported[r] = true
+			errs = append(errs, fmt.Errorf("%s %s is not defined by any systemd-networkd file", r.kind, r.name))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return &net.ApplyError{Artifact: dest, Phase: net.PhaseValidate, Err: errors.Join(errs...)}
+}
+
+func frrReferences(content string) []reference {
+	var result []reference
+
+	for _, m := range frrVRFReference.FindAllStringSubmatch(content, -1) {
+		result = append(result, reference{kind: "vrf", name: m[1]})
+	}
+
+	for _, m := range frrInterfaceReference.FindAllStringSubmatch(content, -1) {
+		result = append(result, reference{kind: "interface", name: m[1] + m[2]})
+	}
+
+	for _, m := range frrVNIReference.FindAllStringSubmatch(content, -1) {
+		result = append(result, reference{kind: "vni", name: m[1]})
+	}
+
+	return result
+}
+
+func nftReferences(content string) []reference {
+	var result []reference
+
+	for _, m := range nftInterfaceReference.FindAllStringSubmatch(content, -1) {
+		for _, q := range quoted.FindAllStringSubmatch(m[1], -1) {
+			// wildcards refer to interfaces not managed by the networker, e.g. tailscale*
+			if strings.Contains(q[1], "*") {
+				continue
+			}
+			result = append(result, reference{kind: "interface", name: q[1]})
+		}
+	}
+
+	return result
+}
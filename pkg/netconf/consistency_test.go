@@ -0,0 +1,103 @@
+package netconf
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	const (
+		frr      = "/etc/frr/frr.conf"
+		nftables = "/etc/nftables/rules"
+	)
+
+	tests := []struct {
+		name         string
+		frr          string
+		nftables     string
+		extraNetdev  string
+		wantArtifact string
+		wantErr      string
+	}{
+		{
+			name:     "rendered testdata is consistent",
+			frr:      "testdata/frr.conf.firewall",
+			nftables: "testdata/nftrules",
+		},
+		{
+			name:         "undefined vrf in frr.conf",
+			frr:          "testdata/frr.conf.firewall_dmz",
+			nftables:     "testdata/nftrules",
+			wantArtifact: frr,
+			wantErr:      "vrf vrf3983 is not defined by any systemd-networkd file",
+		},
+		{
+			name:         "undefined interface in nftables",
+			frr:          "testdata/frr.conf.firewall",
+			nftables:     "testdata/nftrules_dmz",
+			wantArtifact: nftables,
+			wantErr:      "interface vlan3983 is not defined by any systemd-networkd file",
+		},
+		{
+			name:         "duplicate vni",
+			frr:          "testdata/frr.conf.firewall",
+			nftables:     "testdata/nftrules",
+			extraNetdev:  "[NetDev]\nName=vni9999\nKind=vxlan\n\n[VXLAN]\nVNI=3981\n",
+			wantArtifact: "/etc/systemd/network/99-extra.netdev",
+			wantErr:      "VNI 3981 of vni9999 is already used by",
+		},
+		{
+			name:         "duplicate vrf table",
+			frr:          "testdata/frr.conf.firewall",
+			nftables:     "testdata/nftrules",
+			extraNetdev:  "[NetDev]\nName=vrf9999\nKind=vrf\n\n[VRF]\nTable=1000\n",
+			wantArtifact: "/etc/systemd/network/99-extra.netdev",
+			wantErr:      "routing table 1000 of vrf9999 is already used by",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			o := newOptions(WithRoot(t.TempDir()))
+
+			staged := map[string]string{
+				o.path(frr):      tt.frr,
+				o.path(nftables): tt.nftables,
+			}
+
+			files, err := filepath.Glob("testdata/networkd/firewall/*")
+			require.NoError(t, err)
+			for _, f := range files {
+				staged[path.Join(o.path(systemdNetworkPath), filepath.Base(f))] = f
+			}
+
+			if tt.extraNetdev != "" {
+				// already present at the destination instead of being staged
+				dest := o.path("/etc/systemd/network/99-extra.netdev")
+				require.NoError(t, os.MkdirAll(filepath.Dir(dest), 0755))
+				require.NoError(t, os.WriteFile(dest, []byte(tt.extraNetdev), 0600))
+			}
+
+			err = checkConsistency(o, staged)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			errs := net.ApplyErrors(err)
+			require.Len(t, errs, 1)
+			assert.Equal(t, o.path(tt.wantArtifact), errs[0].Artifact)
+			assert.Equal(t, net.PhaseValidate, errs[0].Phase)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
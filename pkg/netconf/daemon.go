@@ -0,0 +1,133 @@
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reconcileDebounce is the time to wait for further changes of the installer configuration before reconciling.
+// Editors and provisioning tools often write a file in several steps.
+const reconcileDebounce = time.Second
+
+// Daemon keeps the network configuration of a running bare metal server in sync with its installer configuration.
+// It reconciles whenever the installer configuration file changes and periodically, and only reloads the services
+// whose artifacts actually changed.
+type Daemon struct {
+	log            *slog.Logger
+	path           string
+	kind           BareMetalType
+	enableDNSProxy bool
+	forwardPolicy  ForwardPolicy
+	interval       time.Duration
+	opts           []Option
+}
+
+// NewDaemon creates a new daemon that reconciles the configuration read from the installer configuration at path.
+// An interval of zero disables periodic reconciliation, changes of the installer configuration are picked up anyway.
+func NewDaemon(log *slog.Logger, path string, kind BareMetalType, enableDNSProxy bool, forwardPolicy ForwardPolicy,
+	interval time.Duration, opts ...Option) *Daemon {
+	return &Daemon{
+		log:            log,
+		path:           path,
+		kind:           kind,
+		enableDNSProxy: enableDNSProxy,
+		forwardPolicy:  forwardPolicy,
+		interval:       interval,
+		opts:           append(slices.Clone(opts), WithServiceReload()),
+	}
+}
+
+// Run reconciles once and then on every change of the installer configuration and every interval until the
+// context is cancelled. Failed reconciliations are logged and retried with the next trigger.
+func (d *Daemon) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create watcher: %w", err)
+	}
+
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	// the directory is watched because the installer configuration may be replaced instead of written in place
+	err = watcher.Add(filepath.Dir(d.path))
+	if err != nil {
+		return fmt.Errorf("unable to watch %s: %w", d.path, err)
+	}
+
+	var tick <-chan time.Time
+	if d.interval > 0 {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	debounce := time.NewTimer(0)
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-debounce.C:
+			d.reconcileAndLog("startup or config change")
+		case <-tick:
+			d.reconcileAndLog("interval")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher of %s closed", d.path)
+			}
+
+			if filepath.Clean(event.Name) != filepath.Clean(d.path) || event.Has(fsnotify.Chmod) {
+				continue
+			}
+
+			d.log.Info("installer configuration changed", "path", d.path, "op", event.Op.String())
+			debounce.Reset(reconcileDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher of %s closed", d.path)
+			}
+
+			d.log.Error("watching installer configuration failed", "path", d.path, "error", err)
+		}
+	}
+}
+
+func (d *Daemon) reconcileAndLog(trigger string) {
+	d.log.Info("reconciling network configuration", "trigger", trigger)
+
+	err := d.reconcile()
+	if err != nil {
+		d.log.Error("reconciling network configuration failed", "error", err)
+		return
+	}
+
+	d.log.Info("network configuration reconciled")
+}
+
+// reconcile reads the installer configuration and applies it.
+func (d *Daemon) reconcile() error {
+	c, err := New(d.log, d.path)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate(d.kind)
+	if err != nil {
+		return err
+	}
+
+	configurator, err := NewConfigurator(d.kind, *c, d.enableDNSProxy, d.opts...)
+	if err != nil {
+		return err
+	}
+
+	return configurator.Configure(d.forwardPolicy)
+}
@@ -0,0 +1,25 @@
+package netconf
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemon_Run(t *testing.T) {
+	installerConfig := path.Join(t.TempDir(), "install.yaml")
+	require.NoError(t, os.WriteFile(installerConfig, []byte("hostname: firewall\n"), 0600))
+
+	d := NewDaemon(slog.Default(), installerConfig, Firewall, false, ForwardPolicyDrop, time.Hour, WithRoot(t.TempDir()))
+	require.EqualError(t, d.reconcile(), "expectation at least one network is present failed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, d.Run(ctx))
+}
@@ -0,0 +1,471 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	// firewallRulesConfig holds firewall rules that cannot be expressed by the firewall rules of metal-api, e.g. rules
+	// with port ranges, ICMP types or without protocol.
+	firewallRulesConfig struct {
+		Egress  []firewallRule `yaml:"egress"`
+		Ingress []firewallRule `yaml:"ingress"`
+	}
+
+	// firewallRule is a firewall rule of metal-api or of the networker section of the installer configuration.
+	firewallRule struct {
+		Comment string `yaml:"comment"`
+		// Protocol is one of tcp, udp, icmp, icmpv6 or any, tcp is used if empty.
+		Protocol string `yaml:"protocol"`
+		// Ports are single ports or port ranges like 8000-8100, all ports are allowed if empty.
+		Ports []string `yaml:"ports"`
+		// ICMPTypes are the names or numbers of the allowed ICMP types, all types are allowed if empty.
+		ICMPTypes []string `yaml:"icmp_types"`
+		// From are the allowed source prefixes of ingress rules.
+		From []string `yaml:"from"`
+		// To are the allowed destination prefixes, ingress rules allow the private primary network if empty.
+		To []string `yaml:"to"`
+		// Log logs the first packet of every accepted connection.
+		Log bool `yaml:"log"`
+		// LogPrefix is prepended to logged packets, it defaults to a prefix naming the direction and index of the rule.
+		LogPrefix string `yaml:"log_prefix"`
+		// Limit limits the rate of accepted packets like 100/second, exceeding packets are not accepted by the rule.
+		Limit string `yaml:"limit"`
+		// ConnectionLimit limits the number of concurrent connections accepted by the rule.
+		ConnectionLimit uint32 `yaml:"connection_limit"`
+
+		// requirePorts is set for rules of metal-api. They list the allowed ports explicitly, allowing all ports is an
+		// opt-in of the rules of the networker section.
+		requirePorts bool
+	}
+
+	// firewallRuleOptions are the options of a rule that apply to all of its addresses.
+	firewallRuleOptions struct {
+		logPrefix       string
+		limit           string
+		connectionLimit uint32
+	}
+
+	// portRange is a range of ports including both ends.
+	portRange struct {
+		from int
+		to   int
+	}
+)
+
+const (
+	defaultDropLogRate   = "2/minute"
+	defaultDropLogPrefix = "nftables-metal-dropped: "
+
+	// maxLogPrefixLength is the maximum length of a log prefix accepted by the kernel.
+	maxLogPrefixLength = 127
+)
+
+const (
+	protocolTCP    = "tcp"
+	protocolUDP    = "udp"
+	protocolICMP   = "icmp"
+	protocolICMPv6 = "icmpv6"
+	protocolAny    = "any"
+)
+
+var (
+	// icmpTypes are the names of ICMP types known to nft.
+	icmpTypes = map[string]byte{
+		"echo-reply":              0,
+		"destination-unreachable": 3,
+		"source-quench":           4,
+		"redirect":                5,
+		"echo-request":            8,
+		"router-advertisement":    9,
+		"router-solicitation":     10,
+		"time-exceeded":           11,
+		"parameter-problem":       12,
+		"timestamp-request":       13,
+		"timestamp-reply":         14,
+		"info-request":            15,
+		"info-reply":              16,
+		"address-mask-request":    17,
+		"address-mask-reply":      18,
+	}
+
+	// icmpv6Types are the names of ICMPv6 types known to nft.
+	icmpv6Types = map[string]byte{
+		"destination-unreachable": 1,
+		"packet-too-big":          2,
+		"time-exceeded":           3,
+		"parameter-problem":       4,
+		"echo-request":            128,
+		"echo-reply":              129,
+		"mld-listener-query":      130,
+		"mld-listener-report":     131,
+		"mld-listener-done":       132,
+		"nd-router-solicit":       133,
+		"nd-router-advert":        134,
+		"nd-neighbor-solicit":     135,
+		"nd-neighbor-advert":      136,
+		"nd-redirect":             137,
+		"router-renumbering":      138,
+		"mld2-listener-report":    143,
+	}
+)
+
+// getFirewallRules returns the egress and ingress rules of metal-api followed by the rules of the networker section of
+// the installer configuration.
+func getFirewallRules(c config) (egress []firewallRule, ingress []firewallRule) {
+	if c.FirewallRules != nil {
+		for _, r := range c.FirewallRules.Egress {
+			if r == nil {
+				continue
+			}
+			egress = append(egress, firewallRule{
+				Comment:      r.Comment,
+				Protocol:     r.Protocol,
+				Ports:        portStrings(r.Ports),
+				To:           r.To,
+				requirePorts: true,
+			})
+		}
+		for _, r := range c.FirewallRules.Ingress {
+			if r == nil {
+				continue
+			}
+			ingress = append(ingress, firewallRule{
+				Comment:      r.Comment,
+				Protocol:     r.Protocol,
+				Ports:        portStrings(r.Ports),
+				From:         r.From,
+				To:           r.To,
+				requirePorts: true,
+			})
+		}
+	}
+
+	egress = append(egress, c.Networker.FirewallRules.Egress...)
+	ingress = append(ingress, c.Networker.FirewallRules.Ingress...)
+
+	return egress, ingress
+}
+
+// validateFirewallRules checks that all firewall rules can be expressed by nftables rules.
+func (c config) validateFirewallRules() error {
+	egress, ingress := getFirewallRules(c)
+
+	var errs []error
+	for i, r := range egress {
+		if err := r.validate(false); err != nil {
+			errs = append(errs, fmt.Errorf("egress firewall rule %d: %w", i, err))
+		}
+	}
+	for i, r := range ingress {
+		if err := r.validate(true); err != nil {
+			errs = append(errs, fmt.Errorf("ingress firewall rule %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r firewallRule) validate(ingress bool) error {
+	protocol := r.protocol()
+	switch protocol {
+	case protocolTCP, protocolUDP, protocolICMP, protocolICMPv6, protocolAny:
+	default:
+		return fmt.Errorf("unsupported protocol %q", r.Protocol)
+	}
+
+	if len(r.Ports) > 0 && protocol != protocolTCP && protocol != protocolUDP {
+		return fmt.Errorf("ports are not supported for protocol %s", protocol)
+	}
+	if _, err := r.portRanges(); err != nil {
+		return err
+	}
+
+	if len(r.ICMPTypes) > 0 && protocol != protocolICMP && protocol != protocolICMPv6 {
+		return fmt.Errorf("icmp types are not supported for protocol %s", protocol)
+	}
+	for _, t := range r.ICMPTypes {
+		if _, err := parseICMPType(protocol, t); err != nil {
+			return err
+		}
+	}
+
+	if r.Limit != "" {
+		if err := validateRate(r.Limit); err != nil {
+			return err
+		}
+	}
+	if len(r.LogPrefix) > maxLogPrefixLength {
+		return fmt.Errorf("log prefix must not be longer than %d characters", maxLogPrefixLength)
+	}
+
+	var addresses []string
+	if ingress {
+		if len(r.From) == 0 {
+			return errors.New("no source prefixes given")
+		}
+		addresses = append(addresses, r.From...)
+
+		families := map[string]bool{}
+		for _, p := range r.To {
+			af, err := getAddressFamily(p)
+			if err != nil {
+				return err
+			}
+			families[af] = true
+		}
+		if len(families) > 1 {
+			return errors.New("destination prefixes must not mix address families")
+		}
+	} else {
+		if len(r.From) > 0 {
+			return errors.New("source prefixes are not supported for egress rules")
+		}
+		if len(r.To) == 0 {
+			return errors.New("no destination prefixes given")
+		}
+	}
+	addresses = append(addresses, r.To...)
+
+	for _, p := range addresses {
+		af, err := getAddressFamily(p)
+		if err != nil {
+			return err
+		}
+		if protocol == protocolICMP && af != "ip" {
+			return fmt.Errorf("prefix %s is not an ipv4 prefix as required by protocol icmp", p)
+		}
+		if protocol == protocolICMPv6 && af != "ip6" {
+			return fmt.Errorf("prefix %s is not an ipv6 prefix as required by protocol icmpv6", p)
+		}
+	}
+
+	return nil
+}
+
+// portRanges returns the allowed port ranges of the rule, all ports are allowed if empty. A tcp or udp rule of
+// metal-api without ports is an error, it must not allow all ports.
+func (r firewallRule) portRanges() ([]portRange, error) {
+	protocol := r.protocol()
+	if r.requirePorts && len(r.Ports) == 0 && (protocol == protocolTCP || protocol == protocolUDP) {
+		return nil, errors.New("no ports given")
+	}
+
+	return parsePortRanges(r.Ports)
+}
+
+// options returns the options of the rule, index is the position of the rule among the rules of the direction.
+func (r firewallRule) options(direction string, index int) firewallRuleOptions {
+	o := firewallRuleOptions{
+		limit:           r.Limit,
+		connectionLimit: r.ConnectionLimit,
+	}
+	if r.Log {
+		o.logPrefix = r.LogPrefix
+		if o.logPrefix == "" {
+			o.logPrefix = fmt.Sprintf("nftables-metal-%s-%d: ", direction, index)
+		}
+	}
+
+	return o
+}
+
+// limited returns true if the options limit the rate or the connections of a rule. Such a rule needs a limit of its
+// own, it must neither share it with other rules nor split it among its ports or address families.
+func (o firewallRuleOptions) limited() bool {
+	return o.limit != "" || o.connectionLimit > 0
+}
+
+// statements returns the statements of an accepting rule with the given options.
+func (o firewallRuleOptions) statements() []NftStatement {
+	var result []NftStatement
+	if o.limit != "" {
+		result = append(result, NftLimit{Rate: o.limit})
+	}
+	if o.connectionLimit > 0 {
+		result = append(result, NftCTCount{Count: o.connectionLimit})
+	}
+	result = append(result, NftCounter{})
+	if o.logPrefix != "" {
+		result = append(result, NftLog{Prefix: o.logPrefix})
+	}
+
+	return result
+}
+
+// statements returns the statements logging dropped packets.
+func (d dropLogConfig) statements() []NftStatement {
+	rate := d.Rate
+	if rate == "" {
+		rate = defaultDropLogRate
+	}
+	prefix := d.Prefix
+	if prefix == "" {
+		prefix = defaultDropLogPrefix
+	}
+
+	return []NftStatement{NftLimit{Rate: rate}, NftCounter{}, NftLog{Prefix: prefix}}
+}
+
+func (d dropLogConfig) validate() error {
+	if d.Rate != "" {
+		if err := validateRate(d.Rate); err != nil {
+			return fmt.Errorf("drop log: %w", err)
+		}
+	}
+	if len(d.Prefix) > maxLogPrefixLength {
+		return fmt.Errorf("drop log: prefix must not be longer than %d characters", maxLogPrefixLength)
+	}
+
+	return nil
+}
+
+// validateRate checks that the given rate like 10/second can be used by a limit statement.
+func validateRate(rate string) error {
+	count, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return fmt.Errorf("invalid rate %q", rate)
+	}
+	if n, err := strconv.ParseUint(count, 10, 64); err != nil || n == 0 {
+		return fmt.Errorf("invalid rate %q", rate)
+	}
+	if !slices.Contains([]string{"second", "minute", "hour", "day"}, unit) {
+		return fmt.Errorf("invalid rate %q", rate)
+	}
+
+	return nil
+}
+
+// protocol returns the normalized protocol of the rule.
+func (r firewallRule) protocol() string {
+	protocol := strings.ToLower(r.Protocol)
+	if protocol == "" {
+		return protocolTCP
+	}
+
+	return protocol
+}
+
+// parsePortRange parses a single port or a port range like 8000-8100.
+func parsePortRange(s string) (portRange, error) {
+	port := func(s string) (int, error) {
+		p, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || p < 1 || p > 65535 {
+			return 0, fmt.Errorf("invalid port %q", s)
+		}
+		return p, nil
+	}
+
+	from, to, isRange := strings.Cut(s, "-")
+	first, err := port(from)
+	if err != nil {
+		return portRange{}, err
+	}
+	if !isRange {
+		return portRange{from: first, to: first}, nil
+	}
+
+	last, err := port(to)
+	if err != nil {
+		return portRange{}, err
+	}
+	if last < first {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return portRange{from: first, to: last}, nil
+}
+
+// String renders the range in nft syntax.
+func (p portRange) String() string {
+	if p.from == p.to {
+		return strconv.Itoa(p.from)
+	}
+
+	return fmt.Sprintf("%d-%d", p.from, p.to)
+}
+
+func (p portRange) contains(other portRange) bool {
+	return p.from <= other.from && other.to <= p.to
+}
+
+func comparePortRanges(a, b portRange) int {
+	if a.from != b.from {
+		return a.from - b.from
+	}
+
+	return a.to - b.to
+}
+
+// parsePortRanges parses the given ports and returns them sorted numerically without duplicates.
+func parsePortRanges(ports []string) ([]portRange, error) {
+	var result []portRange
+	for _, p := range ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pr)
+	}
+	slices.SortFunc(result, comparePortRanges)
+
+	return slices.Compact(result), nil
+}
+
+// mergePortRanges merges overlapping and adjacent port ranges, the given ranges must be sorted.
+func mergePortRanges(ranges []portRange) []portRange {
+	var result []portRange
+	for _, r := range ranges {
+		if n := len(result); n > 0 && r.from <= result[n-1].to+1 {
+			result[n-1].to = max(result[n-1].to, r.to)
+			continue
+		}
+		result = append(result, r)
+	}
+
+	return result
+}
+
+// portSegments splits the given port ranges into disjoint ranges. Every returned range is either contained in or
+// disjoint with each of the given ranges.
+func portSegments(ranges []portRange) []portRange {
+	var bounds []int
+	for _, r := range ranges {
+		bounds = append(bounds, r.from, r.to+1)
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	var result []portRange
+	for i := 0; i+1 < len(bounds); i++ {
+		segment := portRange{from: bounds[i], to: bounds[i+1] - 1}
+		if slices.ContainsFunc(ranges, func(r portRange) bool { return r.contains(segment) }) {
+			result = append(result, segment)
+		}
+	}
+
+	return result
+}
+
+// parseICMPType returns the ICMP type of the given protocol by name or number.
+func parseICMPType(protocol, s string) (byte, error) {
+	types := icmpTypes
+	if protocol == protocolICMPv6 {
+		types = icmpv6Types
+	}
+
+	if t, ok := types[s]; ok {
+		return t, nil
+	}
+
+	t, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s type %q", protocol, s)
+	}
+
+	return byte(t), nil
+}
@@ -0,0 +1,145 @@
+package netconf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewallRule_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    firewallRule
+		ingress bool
+		wantErr string
+	}{
+		{
+			name: "metal-api rule without protocol",
+			rule: firewallRule{Ports: []string{"443"}, To: []string{"0.0.0.0/0"}},
+		},
+		{
+			name: "port range",
+			rule: firewallRule{Protocol: "UDP", Ports: []string{"53", "30000-32767"}, To: []string{"::/0"}},
+		},
+		{
+			name:    "icmp types",
+			rule:    firewallRule{Protocol: "icmp", ICMPTypes: []string{"echo-request", "3"}, From: []string{"10.0.0.0/8"}},
+			ingress: true,
+		},
+		{
+			name: "any protocol",
+			rule: firewallRule{Protocol: "any", To: []string{"10.0.0.0/8", "fd00::/8"}},
+		},
+		{
+			name:    "unsupported protocol",
+			rule:    firewallRule{Protocol: "sctp", To: []string{"0.0.0.0/0"}},
+			wantErr: `unsupported protocol "sctp"`,
+		},
+		{
+			name:    "ports without transport protocol",
+			rule:    firewallRule{Protocol: "any", Ports: []string{"22"}, To: []string{"0.0.0.0/0"}},
+			wantErr: "ports are not supported for protocol any",
+		},
+		{
+			name:    "metal-api rule without ports",
+			rule:    firewallRule{Protocol: "udp", To: []string{"0.0.0.0/0"}, requirePorts: true},
+			wantErr: "no ports given",
+		},
+		{
+			name: "networker rule without ports",
+			rule: firewallRule{Protocol: "udp", To: []string{"0.0.0.0/0"}},
+		},
+		{
+			name:    "invalid port",
+			rule:    firewallRule{Ports: []string{"0"}, To: []string{"0.0.0.0/0"}},
+			wantErr: `invalid port "0"`,
+		},
+		{
+			name:    "reversed port range",
+			rule:    firewallRule{Ports: []string{"2000-1000"}, To: []string{"0.0.0.0/0"}},
+			wantErr: `invalid port range "2000-1000"`,
+		},
+		{
+			name:    "icmp types with tcp",
+			rule:    firewallRule{ICMPTypes: []string{"echo-request"}, To: []string{"0.0.0.0/0"}},
+			wantErr: "icmp types are not supported for protocol tcp",
+		},
+		{
+			name:    "unknown icmpv6 type",
+			rule:    firewallRule{Protocol: "icmpv6", ICMPTypes: []string{"echo-request", "source-quench"}, To: []string{"::/0"}},
+			wantErr: `invalid icmpv6 type "source-quench"`,
+		},
+		{
+			name:    "icmp with ipv6 prefix",
+			rule:    firewallRule{Protocol: "icmp", To: []string{"::/0"}},
+			wantErr: "prefix ::/0 is not an ipv4 prefix as required by protocol icmp",
+		},
+		{
+			name:    "egress without destination",
+			rule:    firewallRule{Ports: []string{"443"}},
+			wantErr: "no destination prefixes given",
+		},
+		{
+			name:    "egress with source",
+			rule:    firewallRule{From: []string{"10.0.0.0/8"}, To: []string{"0.0.0.0/0"}},
+			wantErr: "source prefixes are not supported for egress rules",
+		},
+		{
+			name:    "invalid limit",
+			rule:    firewallRule{Limit: "10/fortnight", To: []string{"0.0.0.0/0"}},
+			wantErr: `invalid rate "10/fortnight"`,
+		},
+		{
+			name:    "log prefix too long",
+			rule:    firewallRule{Log: true, LogPrefix: strings.Repeat("x", 128), To: []string{"0.0.0.0/0"}},
+			wantErr: "log prefix must not be longer than 127 characters",
+		},
+		{
+			name:    "ingress with mixed destinations",
+			rule:    firewallRule{From: []string{"0.0.0.0/0"}, To: []string{"10.0.0.1/32", "fd00::1/128"}},
+			ingress: true,
+			wantErr: "destination prefixes must not mix address families",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate(tt.ingress)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDropLogConfig_Statements(t *testing.T) {
+	assert.Equal(t, []NftStatement{NftLimit{Rate: "2/minute"}, NftCounter{}, NftLog{Prefix: "nftables-metal-dropped: "}},
+		dropLogConfig{}.statements())
+
+	d := dropLogConfig{Rate: "10/second", Prefix: "fw-dropped: "}
+	require.NoError(t, d.validate())
+	assert.Equal(t, []NftStatement{NftLimit{Rate: "10/second"}, NftCounter{}, NftLog{Prefix: "fw-dropped: "}}, d.statements())
+
+	require.EqualError(t, dropLogConfig{Rate: "often"}.validate(), `drop log: invalid rate "often"`)
+}
+
+func TestPortSegments(t *testing.T) {
+	ranges := []portRange{{from: 80, to: 80}, {from: 1, to: 1000}, {from: 443, to: 443}, {from: 8000, to: 8100}, {from: 8100, to: 8200}}
+
+	expected := []portRange{
+		{from: 1, to: 79},
+		{from: 80, to: 80},
+		{from: 81, to: 442},
+		{from: 443, to: 443},
+		{from: 444, to: 1000},
+		{from: 8000, to: 8099},
+		{from: 8100, to: 8100},
+		{from: 8101, to: 8200},
+	}
+	assert.Equal(t, expected, portSegments(ranges))
+}
@@ -0,0 +1,39 @@
+package netconf
+
+import "fmt"
+
+// flowtableName is the name of the flowtable established connections are offloaded to.
+const flowtableName = "fastpath"
+
+// flowOffloadConfig enables the offloading of established connections to a flowtable. Packets of offloaded
+// connections bypass the forward chain, which increases the throughput of the firewall.
+type flowOffloadConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Hardware offloads the connections to the network cards, which must support it.
+	Hardware bool `yaml:"hardware"`
+}
+
+// flowtable returns the flowtable covering the lan interfaces and the SVIs of the tenant networks.
+func (f flowOffloadConfig) flowtable(c config) NftFlowtable {
+	devices := c.getLANInterfaces()
+	for _, e := range getEVPNIfaces(c) {
+		devices = append(devices, fmt.Sprintf("vlan%d", e.VRF.ID))
+	}
+
+	return NftFlowtable{
+		Name:     flowtableName,
+		Priority: "0",
+		Devices:  devices,
+		Offload:  f.Hardware,
+	}
+}
+
+// rule returns the forward rule adding established connections to the flowtable. Only tcp and udp connections can
+// be offloaded.
+func (f flowOffloadConfig) rule() NftRule {
+	return NftRule{
+		Matches:    []NftMatch{nftMatch("meta l4proto", protocolTCP, protocolUDP), nftMatch("ct state", "established")},
+		Statements: []NftStatement{NftFlowOffload{Flowtable: flowtableName}},
+		Comment:    "offload established connections",
+	}
+}
@@ -1,9 +1,12 @@
 package netconf
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"regexp"
+	"strings"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/metal-stack/metal-go/api/models"
@@ -13,8 +16,11 @@ import (
 )
 
 const (
-	// FRRVersion holds a string that is used in the frr.conf to define the FRR version.
-	FRRVersion = "8.5"
+	// FRRVersion is the version frr.conf is rendered for if the installed version is unknown, it is the minimum
+	// supported version.
+	FRRVersion = "10.0"
+	// MinimumFRRMajorVersion is the lowest major version of FRR the rendered configuration is meant for.
+	MinimumFRRMajorVersion = 10
 	// TplFirewallFRR defines the name of the template to render FRR configuration to a 'firewall'.
 	TplFirewallFRR = "frr.firewall.tpl"
 	// TplMachineFRR defines the name of the template to render FRR configuration to a 'machine'.
@@ -39,6 +45,8 @@ type (
 		FRRVersion string
 		Hostname   string
 		RouterID   string
+		// Interfaces are the uplinks BGP unnumbered sessions are established at, one per NIC or the bond of the NICs.
+		Interfaces []string
 	}
 
 	// MachineFRRData contains attributes required to render frr.conf of bare metal servers that function as 'machine'.
@@ -62,20 +70,26 @@ type (
 	AddressFamily string
 )
 
-// NewFrrConfigApplier constructs a new Applier of the given type of Bare Metal.
-func NewFrrConfigApplier(kind BareMetalType, c config, tmpFile string, frrVersion *semver.Version) net.Applier {
+// NewFrrConfigApplier constructs a new Applier of the given type of Bare Metal. frr.conf is rendered for FRRVersion if
+// the given version is nil.
+func NewFrrConfigApplier(kind BareMetalType, c config, tmpFile string, frrVersion *semver.Version) (net.Applier, error) {
 	var data any
 
+	if frrVersion == nil {
+		frrVersion = semver.MustParse(FRRVersion)
+	}
+
 	switch kind {
 	case Firewall:
 		net := c.getUnderlayNetwork()
 		data = FirewallFRRData{
 			CommonFRRData: CommonFRRData{
-				FRRVersion: FRRVersion,
+				FRRVersion: frrVersionLine(frrVersion),
 				Hostname:   c.Hostname,
 				Comment:    versionHeader(c.MachineUUID),
 				ASN:        *net.Asn,
 				RouterID:   routerID(net),
+				Interfaces: c.getUplinkInterfaces(),
 			},
 			VRFs: assembleVRFs(c, frrVersion),
 		}
@@ -83,16 +97,16 @@ func NewFrrConfigApplier(kind BareMetalType, c config, tmpFile string, frrVersio
 		net := c.getPrivatePrimaryNetwork()
 		data = MachineFRRData{
 			CommonFRRData: CommonFRRData{
-				FRRVersion: FRRVersion,
+				FRRVersion: frrVersionLine(frrVersion),
 				Hostname:   c.Hostname,
 				Comment:    versionHeader(c.MachineUUID),
 				ASN:        *net.Asn,
 				RouterID:   routerID(net),
+				Interfaces: c.getUplinkInterfaces(),
 			},
 		}
 	default:
-		c.log.Error("unknown kind of bare metal", "kind", kind)
-		panic(fmt.Errorf("unknown kind %v", kind))
+		return nil, fmt.Errorf("unknown kind %v", kind)
 	}
 
 	validator := frrValidator{
@@ -100,7 +114,61 @@ func NewFrrConfigApplier(kind BareMetalType, c config, tmpFile string, frrVersio
 		log:  c.log,
 	}
 
-	return net.NewNetworkApplier(data, validator, net.NewDBusReloader("frr.service"))
+	return net.NewNetworkApplier(data, validator, net.NewDBusReloader("frr.service")), nil
+}
+
+// frrVersionLine returns the version to write into frr.conf for the given FRR version.
+func frrVersionLine(frrVersion *semver.Version) string {
+	return fmt.Sprintf("%d.%d", frrVersion.Major(), frrVersion.Minor())
+}
+
+// detectFRRVersion returns the version of the installed FRR by asking vtysh and, if that fails, frr itself. The
+// commands are run with the given function, exec.NewVerboseCmd is used if nil.
+func detectFRRVersion(log *slog.Logger, run func(name string, args ...string) (string, error)) (*semver.Version, error) {
+	if run == nil {
+		run = func(name string, args ...string) (string, error) {
+			return exec.NewVerboseCmd(name, args...).Output()
+		}
+	}
+
+	var errs []error
+
+	for _, bin := range []string{"vtysh", "frr"} {
+		out, err := run(bin, "--version")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		v, err := parseFRRVersion(out)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Info("detected frr version", "version", v.String(), "command", bin+" --version")
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("unable to detect frr version: %w", errors.Join(errs...))
+}
+
+// frrVersionOutput matches the version in the first line of the output of vtysh --version or frr --version, e.g.
+// "vtysh 10.1.1" or "FRRouting 10.0.1 (frr) on Linux(6.1.0-18-amd64).".
+var frrVersionOutput = regexp.MustCompile(`^\S+\s+(?:version\s+)?v?(\d+\.\d+(?:\.\d+)?(?:[-~+][0-9A-Za-z.~+-]*)?)`)
+
+func parseFRRVersion(output string) (*semver.Version, error) {
+	line, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+
+	m := frrVersionOutput.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("no frr version found in %q", line)
+	}
+
+	// debian revisions like 10.1.1-0~deb12u1 are no valid semver pre-releases
+	version, _, _ := strings.Cut(m[1], "~")
+
+	return semver.NewVersion(version)
 }
 
 // routerID will calculate the bgp router-id which must only be specified in the ipv6 range.
@@ -2,6 +2,8 @@ package netconf
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"testing"
@@ -76,6 +78,27 @@ func TestFrrConfigApplier(t *testing.T) {
 			configuratorType: Machine,
 			tpl:              TplMachineFRR,
 		},
+		{
+			name:             "machine with four uplinks",
+			input:            "testdata/machine_four_uplinks.yaml",
+			expectedOutput:   "testdata/frr.conf.machine_four_uplinks",
+			configuratorType: Machine,
+			tpl:              TplMachineFRR,
+		},
+		{
+			name:             "machine with lacp bonded uplinks",
+			input:            "testdata/machine_lacp.yaml",
+			expectedOutput:   "testdata/frr.conf.machine_lacp",
+			configuratorType: Machine,
+			tpl:              TplMachineFRR,
+		},
+		{
+			name:             "firewall with three uplinks and an ipv6 underlay",
+			input:            "testdata/firewall_underlay_ipv6.yaml",
+			expectedOutput:   "testdata/frr.conf.firewall_underlay_ipv6",
+			configuratorType: Firewall,
+			tpl:              TplFirewallFRR,
+		},
 		{
 			name:             "standard firewall with lower frr version",
 			input:            "testdata/firewall.yaml",
@@ -99,7 +122,8 @@ func TestFrrConfigApplier(t *testing.T) {
 			log := slog.Default()
 			kb, err := New(log, test.input)
 			require.NoError(t, err)
-			a := NewFrrConfigApplier(test.configuratorType, *kb, "", test.frrVersion)
+			a, err := NewFrrConfigApplier(test.configuratorType, *kb, "", test.frrVersion)
+			require.NoError(t, err)
 			b := bytes.Buffer{}
 
 			tpl := MustParseTpl(test.tpl)
@@ -130,3 +154,85 @@ func TestFRRValidator_Validate(t *testing.T) {
 	actual := validator.Validate()
 	require.Error(t, actual)
 }
+
+func TestParseFRRVersion(t *testing.T) {
+	tests := []struct {
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{output: "vtysh 10.1.1\nCopyright 1996-2005 Kunihiro Ishiguro, et al.\n", want: "10.1.1"},
+		{output: "vtysh 10.0\n", want: "10.0.0"},
+		{output: "vtysh 10.1.1-0~deb12u1\n", want: "10.1.1-0"},
+		{output: "FRRouting 9.0.5 (frr) on Linux(6.1.0-18-amd64).\n", want: "9.0.5"},
+		{output: "zebra version 8.5.4\n", want: "8.5.4"},
+		{output: "command not found\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.output, func(t *testing.T) {
+			v, err := parseFRRVersion(tt.output)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v.String())
+		})
+	}
+}
+
+func TestFRRVersion(t *testing.T) {
+	log := slog.Default()
+
+	explicit := semver.MustParse("10.2.1")
+	v, err := frrVersion(log, newOptions(WithFRRVersion(explicit), WithRoot(t.TempDir())))
+	require.NoError(t, err)
+	assert.Equal(t, explicit, v)
+
+	v, err = frrVersion(log, newOptions(WithRoot(t.TempDir()), WithServiceReload()))
+	require.NoError(t, err)
+	assert.Nil(t, v, "the version of another root must not be detected")
+
+	assert.Equal(t, "10.2", frrVersionLine(explicit))
+	assert.Equal(t, FRRVersion, frrVersionLine(semver.MustParse(FRRVersion)))
+}
+
+func TestFRRVersion_Detection(t *testing.T) {
+	log := slog.Default()
+
+	var called []string
+	o := newOptions(WithServiceReload())
+	o.versionCmd = func(name string, args ...string) (string, error) {
+		called = append(called, name)
+		if name == "vtysh" {
+			return "", errors.New("vtysh: command not found")
+		}
+		return "FRRouting 10.1.1 (frr) on Linux(6.1.0-18-amd64).\n", nil
+	}
+
+	v, err := frrVersion(log, o)
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.1", v.String())
+	assert.Equal(t, []string{"vtysh", "frr"}, called, "frr is asked if vtysh fails")
+}
+
+func TestFRRVersion_DetectionFailed(t *testing.T) {
+	log := slog.Default()
+	failing := func(name string, args ...string) (string, error) {
+		return "", fmt.Errorf("%s: command not found", name)
+	}
+
+	o := newOptions()
+	o.versionCmd = failing
+	v, err := frrVersion(log, o)
+	require.NoError(t, err)
+	assert.Nil(t, v, "frr.conf is rendered for the minimum supported version")
+
+	o = newOptions(WithServiceReload())
+	o.versionCmd = failing
+	_, err = frrVersion(log, o)
+	require.ErrorContains(t, err, "unable to detect frr version")
+	require.ErrorContains(t, err, "vtysh: command not found")
+	require.ErrorContains(t, err, "frr: command not found")
+}
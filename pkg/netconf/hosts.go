@@ -1,6 +1,14 @@
 package netconf
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+
 	"github.com/metal-stack/metal-networker/pkg/net"
 )
 
@@ -29,9 +37,62 @@ func newHostsApplier(kb config, tmpFile string) net.Applier {
 	return net.NewNetworkApplier(data, validator, nil)
 }
 
-// Validate validates hosts file.
+// hostnameLabel matches a single label of a hostname as defined by RFC 1123.
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Validate validates hosts file, every entry must consist of an IP address followed by at least one valid hostname.
 func (v HostsValidator) Validate() error {
-	//nolint:godox
-	// FIXME: How do we validate a hosts file?
+	f, err := os.Open(v.path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var errs []error
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %q is not an IP address", n, fields[0]))
+		}
+
+		if len(fields) == 1 {
+			errs = append(errs, fmt.Errorf("line %d: no hostname given for %s", n, fields[0]))
+		}
+
+		for _, h := range fields[1:] {
+			if err := checkHostname(h); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkHostname(h string) error {
+	if len(h) > 253 {
+		return fmt.Errorf("hostname %q is longer than 253 characters", h)
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("%q is not a valid hostname", h)
+		}
+	}
+
 	return nil
 }
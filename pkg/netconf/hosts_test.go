@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"log/slog"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,3 +26,49 @@ func TestNewHostsApplier(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, string(expected), b.String())
 }
+
+func TestHostsValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			content: "# comment\n127.0.0.1 localhost\n10.0.16.2 firewall firewall.example.com # inline\n::1 ip6-localhost\n",
+		},
+		{
+			name:    "invalid ip",
+			content: "10.0.16.300 firewall\n",
+			wantErr: "line 1: \"10.0.16.300\" is not an IP address",
+		},
+		{
+			name:    "missing hostname",
+			content: "127.0.0.1 localhost\n10.0.16.2\n",
+			wantErr: "line 2: no hostname given for 10.0.16.2",
+		},
+		{
+			name:    "invalid hostname",
+			content: "10.0.16.2 -firewall\n",
+			wantErr: "line 1: \"-firewall\" is not a valid hostname",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := path.Join(t.TempDir(), "hosts")
+			require.NoError(t, os.WriteFile(f, []byte(tt.content), 0600))
+
+			err := HostsValidator{f}.Validate()
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestHostsValidator_Testdata(t *testing.T) {
+	require.NoError(t, HostsValidator{"testdata/hosts"}.Validate())
+}
@@ -1,13 +1,17 @@
 package netconf
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/netip"
+	"os"
 	"text/template"
 
+	"github.com/metal-stack/metal-go/api/models"
 	mn "github.com/metal-stack/metal-lib/pkg/net"
+	"github.com/metal-stack/metal-networker/pkg/net"
 )
 
 type (
@@ -24,11 +28,12 @@ type (
 type ifacesApplier struct {
 	kind BareMetalType
 	kb   config
+	o    options
 	data IfacesData
 }
 
 // newIfacesApplier constructs a new instance of this type.
-func newIfacesApplier(kind BareMetalType, c config) ifacesApplier {
+func newIfacesApplier(kind BareMetalType, c config, o options) (ifacesApplier, error) {
 	d := IfacesData{
 		Comment: versionHeader(c.MachineUUID),
 	}
@@ -46,11 +51,10 @@ func newIfacesApplier(kind BareMetalType, c config) ifacesApplier {
 		// The first lo IP is used within network communication and other systems depend on seeing the first private ip.
 		d.Loopback.IPs = addBitlen(append(private.Ips, c.CollectIPs(mn.External)...))
 	default:
-		c.log.Error("unknown configuratorType", "kind", kind)
-		panic(fmt.Errorf("unknown configurator type:%v", kind))
+		return ifacesApplier{}, fmt.Errorf("unknown configurator type:%v", kind)
 	}
 
-	return ifacesApplier{kind: kind, kb: c, data: d}
+	return ifacesApplier{kind: kind, kb: c, o: o, data: d}, nil
 }
 
 func addBitlen(ips []string) []string {
@@ -71,70 +75,105 @@ func (a *ifacesApplier) Render(w io.Writer, tpl template.Template) error {
 	return tpl.Execute(w, a.data)
 }
 
-// Apply applies the interface configuration with systemd-networkd.
-func (a *ifacesApplier) Apply() {
+// Stage stages the interface configuration for systemd-networkd to the given transaction.
+// All files are staged even if some of them fail, the returned error joins the errors of all failed files.
+func (a *ifacesApplier) Stage(tx *net.Transaction) error {
 	uuid := a.kb.MachineUUID
 	evpnIfaces := a.data.EVPNIfaces
 
+	names := newUnitNames()
+
 	// /etc/systemd/network/00 loopback
-	src := mustTmpFile("lo_network_")
-	applier := newSystemdNetworkdApplier(src, a.data)
-	dest := fmt.Sprintf("%s/00-lo.network", systemdNetworkPath)
-	applyAndCleanUp(a.kb.log, applier, tplSystemdNetworkLo, src, dest, fileModeSystemd, false)
+	networkPath := a.o.path(systemdNetworkPath)
+	dest := fmt.Sprintf("%s/00-lo.network", networkPath)
+	errs := []error{stageNetworkd(a.kb.log, tx, a.o, names, "lo_network_", tplSystemdNetworkLo, dest, a.data)}
+
+	var bond string
+	if a.kb.Networker.Uplinks.bonded() {
+		bond = bondName
+	}
 
 	// /etc/systemd/network/1x* lan interfaces
 	offset := 10
 	for i, nic := range a.kb.Nics {
-		prefix := fmt.Sprintf("lan%d_link_", i)
-		src := mustTmpFile(prefix)
-		applier, err := newSystemdLinkApplier(a.kind, uuid, i, nic, src, evpnIfaces)
-		if err != nil {
-			a.kb.log.Error("unable to create systemdlinkapplier", "error", err)
-			panic(err)
-		}
-		dest := fmt.Sprintf("%s/%d-lan%d.link", systemdNetworkPath, offset+i, i)
-		applyAndCleanUp(a.kb.log, applier, tplSystemdLinkLan, src, dest, fileModeSystemd, false)
+		// udev applies .link files only when a device is added, reloading systemd-networkd does not pick them up.
+		// Changes take effect at the next boot, the artifact is therefore not marked as reloaded.
+		dest := fmt.Sprintf("%s/%d-lan%d.link", networkPath, offset+i, i)
+		errs = append(errs, stageLink(a.kb.log, tx, names, a.kind, uuid, i, nic, fmt.Sprintf("lan%d_link_", i), tplSystemdLinkLan, dest, evpnIfaces, bond, false))
 
-		prefix = fmt.Sprintf("lan%d_network_", i)
-		src = mustTmpFile(prefix)
-		applier, err = newSystemdLinkApplier(a.kind, uuid, i, nic, src, evpnIfaces)
+		dest = fmt.Sprintf("%s/%d-lan%d.network", networkPath, offset+i, i)
+		errs = append(errs, stageLink(a.kb.log, tx, names, a.kind, uuid, i, nic, fmt.Sprintf("lan%d_network_", i), tplSystemdNetworkLan, dest, evpnIfaces, bond, a.o.reloadServices()))
+	}
+
+	// /etc/systemd/network/20 bond of the lan interfaces
+	if bond != "" {
+		data, err := getBondData(a.kind, a.kb)
 		if err != nil {
-			a.kb.log.Error("unable to create systemdlinkapplier", "error", err)
-			panic(err)
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, stageNetdevAndNetwork(a.kb.log, tx, a.o, names, 20, 20, "bond", "", data))
 		}
-		dest = fmt.Sprintf("%s/%d-lan%d.network", systemdNetworkPath, offset+i, i)
-		applyAndCleanUp(a.kb.log, applier, tplSystemdNetworkLan, src, dest, fileModeSystemd, false)
 	}
 
 	if a.kind == Machine {
-		return
+		return errors.Join(errs...)
 	}
 
 	// /etc/systemd/network/20 bridge interface
-	applyNetdevAndNetwork(a.kb.log, 20, 20, "bridge", "", a.data)
+	errs = append(errs, stageNetdevAndNetwork(a.kb.log, tx, a.o, names, 20, 20, "bridge", "", a.data))
 
 	// /etc/systemd/network/3x* triplet of interfaces for a tenant: vrf, svi, vxlan
 	offset = 30
 	for i, tenant := range a.data.EVPNIfaces {
 		suffix := fmt.Sprintf("-%d", tenant.VRF.ID)
-		applyNetdevAndNetwork(a.kb.log, offset, offset+i, "vrf", suffix, tenant)
-		applyNetdevAndNetwork(a.kb.log, offset, offset+i, "svi", suffix, tenant)
-		applyNetdevAndNetwork(a.kb.log, offset, offset+i, "vxlan", suffix, tenant)
+		errs = append(errs,
+			stageNetdevAndNetwork(a.kb.log, tx, a.o, names, offset, offset+i, "vrf", suffix, tenant),
+			stageNetdevAndNetwork(a.kb.log, tx, a.o, names, offset, offset+i, "svi", suffix, tenant),
+			stageNetdevAndNetwork(a.kb.log, tx, a.o, names, offset, offset+i, "vxlan", suffix, tenant),
+		)
+	}
+
+	return errors.Join(errs...)
+}
+
+func stageLink(log *slog.Logger, tx *net.Transaction, names *unitNames, kind BareMetalType, uuid string,
+	nicIndex int, nic *models.V1MachineNic, prefix, tpl, dest string, evpnIfaces []EVPNIface, bond string, reload bool) error {
+	src, err := tmpFile(tx, prefix, dest)
+	if err != nil {
+		return err
+	}
+
+	applier, err := newSystemdLinkApplier(kind, uuid, nicIndex, nic, src, dest, names, evpnIfaces, bond)
+	if err != nil {
+		_ = os.Remove(src)
+		return &net.ApplyError{Artifact: dest, Phase: net.PhaseRender, Err: err}
+	}
+
+	return stage(log, tx, applier, tpl, src, dest, fileModeSystemd, reload)
+}
+
+func stageNetworkd(log *slog.Logger, tx *net.Transaction, o options, names *unitNames, prefix, tpl, dest string, data any) error {
+	src, err := tmpFile(tx, prefix, dest)
+	if err != nil {
+		return err
 	}
+
+	applier := newSystemdNetworkdApplier(src, dest, names, data)
+
+	return stage(log, tx, applier, tpl, src, dest, fileModeSystemd, o.reloadServices())
 }
 
-func applyNetdevAndNetwork(log *slog.Logger, si, di int, prefix, suffix string, data any) {
-	src := mustTmpFile(prefix + "_netdev_")
-	applier := newSystemdNetworkdApplier(src, data)
-	dest := fmt.Sprintf("%s/%d-%s%s.netdev", systemdNetworkPath, di, prefix, suffix)
+func stageNetdevAndNetwork(log *slog.Logger, tx *net.Transaction, o options, names *unitNames, si, di int, prefix, suffix string, data any) error {
+	networkPath := o.path(systemdNetworkPath)
+	dest := fmt.Sprintf("%s/%d-%s%s.netdev", networkPath, di, prefix, suffix)
 	tpl := fmt.Sprintf("networkd/%d-%s.netdev.tpl", si, prefix)
-	applyAndCleanUp(log, applier, tpl, src, dest, fileModeSystemd, false)
+	errNetdev := stageNetworkd(log, tx, o, names, prefix+"_netdev_", tpl, dest, data)
 
-	src = mustTmpFile(prefix + "_network_")
-	applier = newSystemdNetworkdApplier(src, data)
-	dest = fmt.Sprintf("%s/%d-%s%s.network", systemdNetworkPath, di, prefix, suffix)
+	dest = fmt.Sprintf("%s/%d-%s%s.network", networkPath, di, prefix, suffix)
 	tpl = fmt.Sprintf("networkd/%d-%s.network.tpl", si, prefix)
-	applyAndCleanUp(log, applier, tpl, src, dest, fileModeSystemd, false)
+	errNetwork := stageNetworkd(log, tx, o, names, prefix+"_network_", tpl, dest, data)
+
+	return errors.Join(errNetdev, errNetwork)
 }
 
 func getEVPNIfaces(kb config) []EVPNIface {
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/metal-networker/pkg/net"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,28 +28,31 @@ func TestIfacesApplier(t *testing.T) {
 			expectedOutput:   "testdata/networkd/machine",
 			configuratorType: Machine,
 		},
+		{
+			input:            "testdata/machine_lacp.yaml",
+			expectedOutput:   "testdata/networkd/machine_lacp",
+			configuratorType: Machine,
+		},
 	}
 	log := slog.Default()
 
-	tmpPath = os.TempDir()
 	for _, tc := range tests {
-		func() {
-			old := systemdNetworkPath
-			tempdir, err := os.MkdirTemp(os.TempDir(), "networkd*")
-			require.NoError(t, err)
-			systemdNetworkPath = tempdir
-			defer func() {
-				_ = os.RemoveAll(systemdNetworkPath)
-				systemdNetworkPath = old
-			}()
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			t.Parallel()
+			o := newOptions(WithRoot(t.TempDir()))
 			kb, err := New(log, tc.input)
 			require.NoError(t, err)
-			a := newIfacesApplier(tc.configuratorType, *kb)
-			a.Apply()
-			if equal, s := equalDirs(systemdNetworkPath, tc.expectedOutput); !equal {
+			a, err := newIfacesApplier(tc.configuratorType, *kb, o)
+			require.NoError(t, err)
+			_, err = commit(o, func(tx *net.Transaction) error {
+				return a.Stage(tx)
+			})
+			require.NoError(t, err)
+			if equal, s := equalDirs(o.path(systemdNetworkPath), tc.expectedOutput); !equal {
 				t.Error(s)
 			}
-		}()
+		})
 	}
 }
 
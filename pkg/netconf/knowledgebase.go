@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 
 	"github.com/metal-stack/metal-hammer/pkg/api"
@@ -26,7 +27,37 @@ type (
 	// It represents the input yaml that is needed to render network configuration files.
 	config struct {
 		api.InstallerConfig
-		log *slog.Logger
+		Networker networkerConfig
+		log       *slog.Logger
+	}
+
+	// networkerConfig holds the settings of the installer configuration that are only evaluated by metal-networker.
+	// They are read from the networker key of the same file.
+	networkerConfig struct {
+		DNSProxy         dnsProxyConfig         `yaml:"dns_proxy"`
+		FirewallRules    firewallRulesConfig    `yaml:"firewall_rules"`
+		DropLog          dropLogConfig          `yaml:"drop_log"`
+		ManagementAccess managementAccessConfig `yaml:"management_access"`
+		PortForwards     []portForward          `yaml:"port_forwards"`
+		SNAT             []staticSNAT           `yaml:"snat"`
+		FlowOffload      flowOffloadConfig      `yaml:"flow_offload"`
+		Conntrack        conntrackConfig        `yaml:"conntrack"`
+		Uplinks          uplinkConfig           `yaml:"uplinks"`
+	}
+
+	// dropLogConfig configures the logging of dropped packets, which are forwarded to the SIEM by the droptailer.
+	dropLogConfig struct {
+		// Rate limits the number of logged packets like 2/minute.
+		Rate string `yaml:"rate"`
+		// Prefix is prepended to every logged packet.
+		Prefix string `yaml:"prefix"`
+	}
+
+	// dnsProxyConfig configures the DNAT of tenant DNS traffic to the DNS proxy of the firewall.
+	dnsProxyConfig struct {
+		// SourcePrefixes are the tenant prefixes whose DNS traffic is redirected, the prefixes of the private
+		// networks are used if empty.
+		SourcePrefixes []string `yaml:"source_prefixes"`
 	}
 )
 
@@ -46,8 +77,17 @@ func New(log *slog.Logger, path string) (*config, error) {
 		return nil, err
 	}
 
+	networker := struct {
+		Networker networkerConfig `yaml:"networker"`
+	}{}
+	err = yaml.Unmarshal(f, &networker)
+	if err != nil {
+		return nil, err
+	}
+
 	return &config{
 		InstallerConfig: *installer,
+		Networker:       networker.Networker,
 		log:             log,
 	}, nil
 }
@@ -86,6 +126,45 @@ func (c config) Validate(kind BareMetalType) error {
 		if c.isAnyNAT() && len(c.getPrivatePrimaryNetwork().Prefixes) == 0 {
 			return errors.New("private network must not lack prefixes since nat is required")
 		}
+
+		for _, s := range c.DNSServers {
+			if s == nil || s.IP == nil {
+				return errors.New("dns servers must contain an ip")
+			}
+			if _, err := netip.ParseAddr(*s.IP); err != nil {
+				return fmt.Errorf("dns server ip %q is invalid: %w", *s.IP, err)
+			}
+		}
+
+		for _, p := range c.Networker.DNSProxy.SourcePrefixes {
+			if _, err := netip.ParsePrefix(p); err != nil {
+				return fmt.Errorf("dns proxy source prefix %q is invalid: %w", p, err)
+			}
+		}
+
+		if err := c.validateFirewallRules(); err != nil {
+			return err
+		}
+
+		if err := c.Networker.DropLog.validate(); err != nil {
+			return err
+		}
+
+		if err := c.Networker.ManagementAccess.validate(c); err != nil {
+			return err
+		}
+
+		if err := c.validatePortForwards(); err != nil {
+			return err
+		}
+
+		if err := c.validateStaticSNAT(); err != nil {
+			return err
+		}
+
+		if err := c.Networker.Conntrack.validate(); err != nil {
+			return err
+		}
 	}
 
 	net := c.getPrivatePrimaryNetwork()
@@ -111,6 +190,10 @@ func (c config) Validate(kind BareMetalType) error {
 		return errors.New("each 'nic' definition must contain a valid 'mac'")
 	}
 
+	if err := c.Networker.Uplinks.validate(kind, len(c.Nics)); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -188,6 +271,16 @@ func (c config) getUnderlayNetwork() *models.V1MachineNetwork {
 	return c.GetNetworks(mn.Underlay)[0]
 }
 
+// getLANInterfaces returns the names of the interfaces of the NICs, they are named in the order of the NICs.
+func (c config) getLANInterfaces() []string {
+	var result []string
+	for i := range c.Nics {
+		result = append(result, fmt.Sprintf("lan%d", i))
+	}
+
+	return result
+}
+
 func (c config) GetDefaultRouteNetwork() *models.V1MachineNetwork {
 	externalNets := c.GetNetworks(mn.External)
 	for _, network := range externalNets {
@@ -244,10 +337,15 @@ func (c config) allNonUnderlayNetworksHaveNonZeroVRF() bool {
 }
 
 func versionHeader(uuid string) string {
-	version := v.V.String()
+	return fmt.Sprintf("# This file was auto generated for machine: '%s' by app version %s.\n# Do not edit.",
+		uuid, version())
+}
+
+// version returns the version of the metal-networker, it is empty in tests to get reproducible artifacts.
+func version() string {
 	if os.Getenv("GO_ENV") == "testing" {
-		version = ""
+		return ""
 	}
-	return fmt.Sprintf("# This file was auto generated for machine: '%s' by app version %s.\n# Do not edit.",
-		uuid, version)
+
+	return v.V.String()
 }
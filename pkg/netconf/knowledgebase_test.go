@@ -175,6 +175,15 @@ func TestKnowledgeBase_Validate(t *testing.T) {
 		{expectedErrMsg: "each 'nic' definition must contain a valid 'mac'",
 			kb:    unlegalizeMACs(stubKnowledgeBase()),
 			kinds: []BareMetalType{Firewall, Machine}},
+		{expectedErrMsg: `dns server ip "8.8.8" is invalid: ParseAddr("8.8.8"): IPv4 address too short`,
+			kb:    setupIllegalDNSServer(stubKnowledgeBase()),
+			kinds: []BareMetalType{Firewall}},
+		{expectedErrMsg: `dns proxy source prefix "10.0.0.0" is invalid: netip.ParsePrefix("10.0.0.0"): no '/'`,
+			kb:    setupIllegalDNSProxySourcePrefix(stubKnowledgeBase()),
+			kinds: []BareMetalType{Firewall}},
+		{expectedErrMsg: "egress firewall rule 0: ports are not supported for protocol icmp",
+			kb:    setupIllegalFirewallRule(stubKnowledgeBase()),
+			kinds: []BareMetalType{Firewall}},
 	}
 
 	for i, test := range tests {
@@ -228,6 +237,24 @@ func setupIllegalNat(kb config) config {
 	return kb
 }
 
+func setupIllegalDNSServer(kb config) config {
+	ip := "8.8.8"
+	kb.DNSServers = []*models.V1DNSServer{{IP: &ip}}
+	return kb
+}
+
+func setupIllegalDNSProxySourcePrefix(kb config) config {
+	kb.Networker.DNSProxy.SourcePrefixes = []string{"10.0.0.0"}
+	return kb
+}
+
+func setupIllegalFirewallRule(kb config) config {
+	kb.FirewallRules = &models.V1FirewallRules{
+		Egress: []*models.V1FirewallEgressRule{{Protocol: "icmp", Ports: []int32{8}, To: []string{"0.0.0.0/0"}}},
+	}
+	return kb
+}
+
 func unlegalizeMACs(kb config) config {
 	mac := "1:2.3"
 	for i := 0; i < len(kb.Nics); i++ {
@@ -0,0 +1,142 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type (
+	// managementAccessConfig restricts the access to the services of the firewall itself. If services are given, they
+	// replace the default rules allowing SSH from everywhere and the metrics ports from the private VRFs.
+	managementAccessConfig struct {
+		Services []managementService `yaml:"services"`
+	}
+
+	// managementService is a service of the firewall that may be reached from the given sources.
+	managementService struct {
+		// Name names the service in the comment of its rule. The ports of the well-known services ssh, node-exporter
+		// and nftables-exporter do not need to be given.
+		Name string `yaml:"name"`
+		// Protocol is either tcp or udp, tcp is used if empty.
+		Protocol string `yaml:"protocol"`
+		// Ports are single ports or port ranges like 8000-8100.
+		Ports []string `yaml:"ports"`
+		// From are the allowed source prefixes, all sources are allowed if empty.
+		From []string `yaml:"from"`
+		// VRFs are the VRFs the service may be reached from, all VRFs are allowed if empty.
+		VRFs []int64 `yaml:"vrfs"`
+	}
+)
+
+// managementServicePorts are the ports of the well-known management services.
+var managementServicePorts = map[string][]string{
+	"ssh":               {"22"},
+	"node-exporter":     {"9100"},
+	"nftables-exporter": {"9630"},
+}
+
+// validate checks that all services can be expressed by nftables rules and only refer to VRFs of the given networks.
+func (m managementAccessConfig) validate(c config) error {
+	var vrfs []int64
+	for _, n := range c.Networks {
+		if n.Vrf != nil {
+			vrfs = append(vrfs, *n.Vrf)
+		}
+	}
+
+	var errs []error
+	for i, s := range m.Services {
+		if err := s.validate(vrfs); err != nil {
+			errs = append(errs, fmt.Errorf("management service %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s managementService) validate(vrfs []int64) error {
+	if s.Name == "" {
+		return errors.New("no name given")
+	}
+
+	protocol := firewallRule{Protocol: s.Protocol}.protocol()
+	if protocol != protocolTCP && protocol != protocolUDP {
+		return fmt.Errorf("unsupported protocol %q", s.Protocol)
+	}
+
+	if len(s.ports()) == 0 {
+		return fmt.Errorf("no ports given for service %s", s.Name)
+	}
+	for _, p := range s.ports() {
+		if _, err := parsePortRange(p); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range s.From {
+		if _, err := getAddressFamily(p); err != nil {
+			return err
+		}
+	}
+
+	for _, vrf := range s.VRFs {
+		if !slices.Contains(vrfs, vrf) {
+			return fmt.Errorf("vrf %d is not a vrf of the networks", vrf)
+		}
+	}
+
+	return nil
+}
+
+// ports returns the given ports or the ports of a well-known service.
+func (s managementService) ports() []string {
+	if len(s.Ports) > 0 {
+		return s.Ports
+	}
+
+	return managementServicePorts[s.Name]
+}
+
+// rules returns the input rules accepting the management services, one per address family of the sources.
+func (m managementAccessConfig) rules() []NftRule {
+	var result []NftRule
+
+	for _, s := range m.Services {
+		var matches []NftMatch
+		if len(s.VRFs) > 0 {
+			var ifaces []string
+			for _, vrf := range s.VRFs {
+				ifaces = append(ifaces, fmt.Sprintf("vrf%d", vrf))
+			}
+			matches = append(matches, nftIfname("iifname", ifaces...))
+		}
+
+		protocol := firewallRule{Protocol: s.Protocol}.protocol()
+		dport := nftMatch(protocol+" dport", s.ports()...)
+
+		rule := func(matches ...NftMatch) NftRule {
+			return NftRule{
+				Matches:    matches,
+				Statements: []NftStatement{NftCounter{}},
+				Verdict:    NftAccept,
+				Comment:    s.Name,
+			}
+		}
+
+		if len(s.From) == 0 {
+			result = append(result, rule(append(matches, dport)...))
+			continue
+		}
+
+		for _, af := range []string{"ip", "ip6"} {
+			from := filterAddressFamily(s.From, af)
+			if len(from) == 0 {
+				continue
+			}
+			result = append(result, rule(append(slices.Clone(matches), nftMatch(af+" saddr", from...), dport)...))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,66 @@
+package netconf
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagementAccessConfig_Validate(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		service managementService
+		wantErr string
+	}{
+		{
+			name:    "well-known service",
+			service: managementService{Name: "nftables-exporter", VRFs: []int64{3981, 3982}},
+		},
+		{
+			name:    "additional service",
+			service: managementService{Name: "health", Protocol: "udp", Ports: []string{"8000-8010"}, From: []string{"fd00::/8"}},
+		},
+		{
+			name:    "missing name",
+			service: managementService{Ports: []string{"22"}},
+			wantErr: "management service 0: no name given",
+		},
+		{
+			name:    "missing ports",
+			service: managementService{Name: "looking-glass"},
+			wantErr: "management service 0: no ports given for service looking-glass",
+		},
+		{
+			name:    "unsupported protocol",
+			service: managementService{Name: "ssh", Protocol: "icmp"},
+			wantErr: `management service 0: unsupported protocol "icmp"`,
+		},
+		{
+			name:    "invalid source",
+			service: managementService{Name: "ssh", From: []string{"10.0.0.1"}},
+			wantErr: `management service 0: netip.ParsePrefix("10.0.0.1"): no '/'`,
+		},
+		{
+			name:    "unknown vrf",
+			service: managementService{Name: "ssh", VRFs: []int64{42}},
+			wantErr: "management service 0: vrf 42 is not a vrf of the networks",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m := managementAccessConfig{Services: []managementService{tt.service}}
+			err := m.validate(*kb)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
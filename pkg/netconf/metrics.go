@@ -0,0 +1,217 @@
+package netconf
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+const (
+	// DefaultMetricsTextfile is the file the metrics are written to by default. It is read by the textfile collector
+	// of the node_exporter deployed to firewalls.
+	DefaultMetricsTextfile = "/var/lib/node_exporter/textfile_collector/metal_networker.prom"
+	// metricLastSuccessfulTime is the name of the metric with the time of the last successful configuration run.
+	metricLastSuccessfulTime = "metal_networker_last_successful_apply_timestamp_seconds"
+	// metricValidationFailures is the name of the counter of failed validations per artifact.
+	metricValidationFailures = "metal_networker_artifact_validation_failures_total"
+	// metricReloadFailures is the name of the counter of failed reloads per artifact.
+	metricReloadFailures = "metal_networker_artifact_reload_failures_total"
+)
+
+// Metrics records the outcome of configuration runs per artifact and writes them to a textfile to be exposed by the
+// node_exporter. A single instance should be shared by all runs of a process to keep its counters.
+type Metrics struct {
+	textfile string
+	registry *prometheus.Registry
+
+	// artifacts are the artifacts of the last configuration run, the series of other artifacts are removed.
+	artifacts map[string]bool
+	// lastSuccessful is the time of the last successful configuration run, zero if it is unknown yet.
+	lastSuccessful float64
+	// restored is true once the metrics of the previous textfile have been restored.
+	restored bool
+
+	renderDuration     *prometheus.GaugeVec
+	validateDuration   *prometheus.GaugeVec
+	changed            *prometheus.GaugeVec
+	validationFailures *prometheus.CounterVec
+	reloadFailures     *prometheus.CounterVec
+	lastApplySuccess   prometheus.Gauge
+	lastSuccessfulTime prometheus.Gauge
+}
+
+// NewMetrics creates new metrics that are written to the given textfile after every configuration run. The textfile
+// is located below the root directory of the configurator.
+func NewMetrics(textfile string) *Metrics {
+	m := &Metrics{
+		textfile:  textfile,
+		registry:  prometheus.NewRegistry(),
+		artifacts: map[string]bool{},
+		renderDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "metal_networker_artifact_render_duration_seconds",
+			Help: "Duration of rendering the artifact in the last configuration run.",
+		}, []string{"artifact"}),
+		validateDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "metal_networker_artifact_validate_duration_seconds",
+			Help: "Duration of validating the artifact in the last configuration run.",
+		}, []string{"artifact"}),
+		changed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "metal_networker_artifact_changed",
+			Help: "Whether the artifact was changed by the last configuration run (1) or not (0).",
+		}, []string{"artifact"}),
+		validationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metricValidationFailures,
+			Help: "Number of failed validations of the artifact.",
+		}, []string{"artifact"}),
+		reloadFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metricReloadFailures,
+			Help: "Number of failed service reloads caused by the artifact.",
+		}, []string{"artifact"}),
+		lastApplySuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "metal_networker_last_apply_success",
+			Help: "Whether the last configuration run succeeded (1) or failed (0).",
+		}),
+		lastSuccessfulTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: metricLastSuccessfulTime,
+			Help: "Unix timestamp of the last successful configuration run.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.renderDuration,
+		m.validateDuration,
+		m.changed,
+		m.validationFailures,
+		m.reloadFailures,
+		m.lastApplySuccess,
+		m.lastSuccessfulTime,
+	)
+
+	return m
+}
+
+// WithMetrics lets the configurator record the outcome of every configuration run in the given metrics.
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// observe records the artifacts of a configuration run that finished with the given error and writes the textfile.
+// The counters and the time of the last successful run are restored from the previous textfile on the first run of
+// the process, so that they survive the runs of a one-shot process.
+func (m *Metrics) observe(textfile string, artifacts []net.Artifact, err error, now time.Time) error {
+	if !m.restored {
+		m.restore(textfile)
+		m.restored = true
+	}
+
+	m.renderDuration.Reset()
+	m.validateDuration.Reset()
+	m.changed.Reset()
+
+	current := map[string]bool{}
+	for _, a := range artifacts {
+		current[a.Dest] = true
+
+		m.renderDuration.WithLabelValues(a.Dest).Set(a.RenderDuration.Seconds())
+		m.validateDuration.WithLabelValues(a.Dest).Set(a.ValidateDuration.Seconds())
+		m.changed.WithLabelValues(a.Dest).Set(boolToFloat(a.Changed))
+
+		// counters are initialized to expose a zero value for every known artifact
+		validationFailures := m.validationFailures.WithLabelValues(a.Dest)
+		reloadFailures := m.reloadFailures.WithLabelValues(a.Dest)
+
+		if a.Err == nil {
+			continue
+		}
+
+		switch a.Err.Phase {
+		case net.PhaseValidate:
+			validationFailures.Inc()
+		case net.PhaseReload:
+			reloadFailures.Inc()
+		}
+	}
+
+	// the counters of artifacts that are not handled anymore are removed
+	for dest := range m.artifacts {
+		if !current[dest] {
+			m.validationFailures.DeleteLabelValues(dest)
+			m.reloadFailures.DeleteLabelValues(dest)
+		}
+	}
+	m.artifacts = current
+
+	m.lastApplySuccess.Set(boolToFloat(err == nil))
+	if err == nil {
+		m.lastSuccessful = float64(now.Unix())
+	}
+	m.lastSuccessfulTime.Set(m.lastSuccessful)
+
+	return m.write(textfile)
+}
+
+// restore continues the counters and the time of the last successful configuration run of the previous textfile,
+// which was written by an earlier run of this or another process. Counters of a one-shot process would start at zero
+// on every run otherwise.
+func (m *Metrics) restore(textfile string) {
+	f, err := os.Open(textfile)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return
+	}
+
+	for name, counter := range map[string]*prometheus.CounterVec{
+		metricValidationFailures: m.validationFailures,
+		metricReloadFailures:     m.reloadFailures,
+	} {
+		family, ok := families[name]
+		if !ok {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "artifact" {
+					counter.WithLabelValues(label.GetValue()).Add(metric.GetCounter().GetValue())
+					m.artifacts[label.GetValue()] = true
+				}
+			}
+		}
+	}
+
+	if family, ok := families[metricLastSuccessfulTime]; ok && len(family.GetMetric()) > 0 {
+		m.lastSuccessful = family.GetMetric()[0].GetGauge().GetValue()
+	}
+}
+
+func (m *Metrics) write(textfile string) error {
+	err := os.MkdirAll(filepath.Dir(textfile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return prometheus.WriteToTextfile(textfile, m.registry)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
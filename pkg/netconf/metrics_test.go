@@ -0,0 +1,100 @@
+package netconf
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+func TestMetrics(t *testing.T) {
+	textfile := path.Join(t.TempDir(), "textfile_collector", "metal_networker.prom")
+	m := NewMetrics(textfile)
+
+	artifacts := []net.Artifact{
+		{Dest: "/etc/frr/frr.conf", RenderDuration: 2 * time.Second, Changed: true, Reloaded: true},
+		{Dest: "/etc/nftables/rules", Err: &net.ApplyError{Artifact: "/etc/nftables/rules", Phase: net.PhaseValidate}},
+	}
+
+	err := m.observe(textfile, artifacts[:1], nil, time.Unix(1700000000, 0))
+	require.NoError(t, err)
+
+	failed := errors.New("failed")
+	err = m.observe(textfile, artifacts, failed, time.Unix(1700000100, 0))
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+
+	for _, want := range []string{
+		`metal_networker_artifact_render_duration_seconds{artifact="/etc/frr/frr.conf"} 2`,
+		`metal_networker_artifact_changed{artifact="/etc/frr/frr.conf"} 1`,
+		`metal_networker_artifact_changed{artifact="/etc/nftables/rules"} 0`,
+		`metal_networker_artifact_validation_failures_total{artifact="/etc/frr/frr.conf"} 0`,
+		`metal_networker_artifact_validation_failures_total{artifact="/etc/nftables/rules"} 1`,
+		`metal_networker_artifact_reload_failures_total{artifact="/etc/nftables/rules"} 0`,
+		`metal_networker_last_apply_success 0`,
+		`metal_networker_last_successful_apply_timestamp_seconds 1.7e+09`,
+	} {
+		assert.Contains(t, string(content), want)
+	}
+}
+
+func TestMetrics_RemovedArtifacts(t *testing.T) {
+	textfile := path.Join(t.TempDir(), "metal_networker.prom")
+	m := NewMetrics(textfile)
+
+	err := m.observe(textfile, []net.Artifact{{Dest: "/etc/frr/frr.conf"}, {Dest: "/etc/hosts"}}, nil, time.Unix(1700000000, 0))
+	require.NoError(t, err)
+	err = m.observe(textfile, []net.Artifact{{Dest: "/etc/frr/frr.conf"}}, nil, time.Unix(1700000100, 0))
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `metal_networker_artifact_changed{artifact="/etc/frr/frr.conf"} 0`)
+	assert.NotContains(t, string(content), "/etc/hosts")
+}
+
+func TestMetrics_LastSuccessfulTimeOfPreviousProcess(t *testing.T) {
+	textfile := path.Join(t.TempDir(), "metal_networker.prom")
+
+	err := NewMetrics(textfile).observe(textfile, nil, nil, time.Unix(1700000000, 0))
+	require.NoError(t, err)
+
+	// a failed run of another process keeps the time of the last successful run
+	err = NewMetrics(textfile).observe(textfile, nil, errors.New("failed"), time.Unix(1700000100, 0))
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `metal_networker_last_apply_success 0`)
+	assert.Contains(t, string(content), `metal_networker_last_successful_apply_timestamp_seconds 1.7e+09`)
+}
+
+func TestMetrics_CountersOfPreviousProcess(t *testing.T) {
+	textfile := path.Join(t.TempDir(), "metal_networker.prom")
+	failed := []net.Artifact{
+		{Dest: "/etc/nftables/rules", Err: &net.ApplyError{Artifact: "/etc/nftables/rules", Phase: net.PhaseValidate}},
+		{Dest: "/etc/hosts"},
+	}
+
+	// every run of a one-shot process creates new metrics
+	for i := range 2 {
+		err := NewMetrics(textfile).observe(textfile, failed, errors.New("failed"), time.Unix(1700000000+int64(i), 0))
+		require.NoError(t, err)
+	}
+	err := NewMetrics(textfile).observe(textfile, failed[:1], nil, time.Unix(1700000100, 0))
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `metal_networker_artifact_validation_failures_total{artifact="/etc/nftables/rules"} 3`)
+	assert.Contains(t, string(content), `metal_networker_artifact_reload_failures_total{artifact="/etc/nftables/rules"} 0`)
+	assert.NotContains(t, string(content), "/etc/hosts", "counters of artifacts that are not handled anymore are removed")
+}
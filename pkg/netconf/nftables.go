@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -20,53 +22,98 @@ const (
 	dnsPort         = "domain"
 	nftablesService = "nftables.service"
 	systemctlBin    = "/bin/systemctl"
-
-	// Set up additional conntrack zone for DNS traffic.
-	// There was a problem that duplicate packets were registered by conntrack
-	// when packet was leaking from private VRF to the internet VRF.
-	// Isolating traffic to special zone solves the problem.
-	// Zone number(3) was obtained by experiments.
-	dnsProxyZone = "3"
 )
 
+// defaultUnderlayPrefixes are the prefixes VXLAN traffic is accepted from if the underlay network has no prefixes.
+var defaultUnderlayPrefixes = []string{"10.0.0.0/8"}
+
+// defaultDNSProxyServers are the upstream resolvers whose traffic is redirected to the DNS proxy if the installer
+// configuration does not contain dns servers.
+var defaultDNSProxyServers = []string{
+	"8.8.8.8", "8.8.4.4", "1.1.1.1", "1.0.0.1",
+	"2001:4860:4860::8888", "2001:4860:4860::8844", "2606:4700:4700::1111", "2606:4700:4700::1001",
+}
+
 type (
 	// NftablesData represents the information required to render nftables configuration.
 	NftablesData struct {
-		Comment       string
-		SNAT          []SNAT
-		DNSProxyDNAT  DNAT
-		VPN           bool
-		ForwardPolicy string
-		FirewallRules FirewallRules
-		Input         Input
+		Comment string
+		Ruleset NftRuleset
 	}
 
+	// Input holds the interfaces of the tenant VRFs that are allowed to access services of the firewall.
 	Input struct {
 		InInterfaces []string
 	}
 
-	FirewallRules struct {
-		Egress  []string
-		Ingress []string
+	// firewallRuleGroups collects the firewall rules of one direction grouped by protocol and port set.
+	firewallRuleGroups struct {
+		direction string
+		// protocols holds the protocols in the order of their first appearance.
+		protocols []string
+		groups    map[string][]*firewallRuleGroup
+		// limited are the rules with a limit or a connection limit, they are not grouped.
+		limited []limitedFirewallRule
+	}
+
+	// limitedFirewallRule is a firewall rule with a limit or a connection limit. All its ports and addresses are
+	// matched before jumping into a chain with a single rule, so that they share one limit.
+	limitedFirewallRule struct {
+		protocol string
+		// ports are the allowed port ranges sorted numerically without overlaps, all ports are allowed if empty.
+		ports []portRange
+		types []string
+		// destination restricts the destination of ingress rules, it is nil for egress rules.
+		destination *NftMatch
+		// side is the side of the packet the addresses are matched with, either saddr or daddr.
+		side string
+		// addresses are the addresses per address family.
+		addresses map[string][]string
+		options   firewallRuleOptions
+		comment   string
+	}
+
+	// firewallRuleGroup holds the addresses of all rules allowing the same ports or ICMP types to the same destination.
+	// Only rules with the same comment share a group, so that every hit can be traced to the rule that matched.
+	firewallRuleGroup struct {
+		// ports are the allowed port ranges sorted numerically, all ports are allowed if empty.
+		ports []portRange
+		// types are the allowed ICMP types, all types are allowed if empty.
+		types []string
+		// destination restricts the destination of ingress rules, it is nil for egress rules.
+		destination *NftMatch
+		// left is the left hand side the addresses are matched with, e.g. "ip daddr".
+		left      string
+		options   firewallRuleOptions
+		comment   string
+		addresses []string
 	}
 
 	// SNAT holds the information required to configure Source NAT.
 	SNAT struct {
 		Comment      string
 		OutInterface string
-		OutIntSpec   AddrSpec
-		SourceSpecs  []AddrSpec
+		// OutIntSpecs are the addresses of the outgoing interface that are not masqueraded, one per address family.
+		OutIntSpecs []AddrSpec
+		SourceSpecs []AddrSpec
+		// To are the addresses to translate to, the source is masqueraded if empty.
+		To []string
 	}
 
 	// DNAT holds the information required to configure DNAT.
 	DNAT struct {
 		Comment      string
 		InInterfaces []string
-		SAddr        string
-		DAddr        string
 		Port         string
-		Zone         string
-		DestSpec     AddrSpec
+		// Specs holds the destination of the DNAT, one per address family.
+		Specs []DNATSpec
+	}
+
+	// DNATSpec holds the DNAT of a single address family.
+	DNATSpec struct {
+		SAddr    []string
+		DAddr    string
+		DestSpec AddrSpec
 	}
 
 	AddrSpec struct {
@@ -84,24 +131,191 @@ type (
 )
 
 // newNftablesConfigApplier constructs a new instance of this type.
-func newNftablesConfigApplier(c config, validator net.Validator, enableDNSProxy bool, forwardPolicy ForwardPolicy) net.Applier {
+func newNftablesConfigApplier(c config, validator net.Validator, enableDNSProxy bool, forwardPolicy ForwardPolicy) (net.Applier, error) {
+	ruleset, err := newNftablesRuleset(c, enableDNSProxy, forwardPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return newNftablesRulesetApplier(c, ruleset, validator, &NftablesReloader{}), nil
+}
+
+// newNftablesRulesetApplier constructs an applier that renders the given ruleset.
+func newNftablesRulesetApplier(c config, ruleset NftRuleset, validator net.Validator, reloader net.Reloader) net.Applier {
 	data := NftablesData{
-		Comment:       versionHeader(c.MachineUUID),
-		SNAT:          getSNAT(c, enableDNSProxy),
-		ForwardPolicy: string(forwardPolicy),
-		FirewallRules: getFirewallRules(c),
-		Input:         getInput(c),
+		Comment: versionHeader(c.MachineUUID),
+		Ruleset: ruleset,
 	}
 
+	return net.NewNetworkApplier(data, validator, reloader)
+}
+
+// newNftablesRuleset assembles the complete ruleset of a firewall.
+func newNftablesRuleset(c config, enableDNSProxy bool, forwardPolicy ForwardPolicy) (NftRuleset, error) {
+	var dnat DNAT
 	if enableDNSProxy {
-		data.DNSProxyDNAT = getDNSProxyDNAT(c, dnsPort, dnsProxyZone)
+		dnat = getDNSProxyDNAT(c, dnsPort)
 	}
 
+	r := NftRuleset{}
+	err := addMetalTable(r.Table("inet", "metal"), c, dnat, forwardPolicy)
+	if err != nil {
+		return NftRuleset{}, err
+	}
+	addNatTable(r.Table("inet", "nat"), c, getSNAT(c, enableDNSProxy), dnat)
+
+	return r, nil
+}
+
+// addMetalTable adds the filter chains of the firewall to the given table.
+func addMetalTable(t *NftTable, c config, dnat DNAT, forwardPolicy ForwardPolicy) error {
+	counter := []NftStatement{NftCounter{}}
+	refuseLog := c.Networker.DropLog.statements()
+	stateEstablished := nftMatch("ct state", "established,related")
+	stateInvalid := nftMatch("ct state", "invalid")
+	icmpv6 := nftMatch("meta l4proto", "ipv6-icmp")
+	bgpUnnumbered := []NftMatch{nftMatch("ip6 saddr", "fe80::/64"), nftMatch("tcp dport", "bgp")}
+	lans := c.getLANInterfaces()
+	underlay := getUnderlayPrefixes(c)
+
+	input := t.BaseChain("input", NftHook{Type: "filter", Hook: "input", Priority: "0", Policy: "drop"})
+	input.Add(
+		NftRule{Matches: []NftMatch{icmpv6}, Statements: counter, Verdict: NftAccept, Comment: "icmpv6 input required for neighbor discovery"},
+		NftRule{Matches: []NftMatch{nftIfname("iifname", "lo")}, Statements: counter, Verdict: NftAccept, Comment: "BGP unnumbered"},
+	)
+	for _, lan := range lans {
+		input.Add(NftRule{Matches: append([]NftMatch{nftIfname("iifname", lan)}, bgpUnnumbered...), Statements: counter, Verdict: NftAccept, Comment: "bgp unnumbered input from " + lan})
+	}
+	for _, lan := range lans {
+		for _, af := range []string{"ip", "ip6"} {
+			if prefixes := filterAddressFamily(underlay, af); len(prefixes) > 0 {
+				input.Add(NftRule{Matches: []NftMatch{nftIfname("iifname", lan), nftMatch(af+" saddr", prefixes...), nftMatch("udp dport", "4789")}, Statements: counter, Verdict: NftAccept, Comment: "incoming VXLAN " + lan})
+			}
+		}
+	}
+	input.Add(NftRule{Matches: []NftMatch{stateEstablished}, Statements: counter, Verdict: NftAccept, Comment: "stateful input"})
+	input.Add(dnat.inputRules()...)
 	if c.VPN != nil {
-		data.VPN = true
+		input.Add(NftRule{Matches: []NftMatch{nftIfname("iifname", "tailscale*")}, Verdict: NftAccept, Comment: "Accept tailscale traffic"})
+	}
+	if len(c.Networker.ManagementAccess.Services) > 0 {
+		input.Add(c.Networker.ManagementAccess.rules()...)
+	} else {
+		if c.VPN == nil {
+			input.Add(NftRule{Matches: []NftMatch{nftMatch("tcp dport", "ssh"), nftMatch("ct state", "new")}, Statements: counter, Verdict: NftAccept, Comment: "SSH incoming connections"})
+		}
+		input.Add(getInput(c).rules()...)
+	}
+	input.Add(
+		NftRule{Matches: []NftMatch{stateInvalid}, Statements: counter, Verdict: NftDrop, Comment: "drop invalid packets to prevent malicious activity"},
+		NftRule{Statements: counter, Verdict: NftJump("refuse")},
+	)
+
+	forward := t.BaseChain("forward", NftHook{Type: "filter", Hook: "forward", Priority: "0", Policy: string(forwardPolicy)})
+	if c.Networker.FlowOffload.Enabled {
+		t.AddFlowtable(c.Networker.FlowOffload.flowtable(c))
+		forward.Add(c.Networker.FlowOffload.rule())
+	}
+	forward.Add(
+		NftRule{Matches: []NftMatch{stateInvalid}, Statements: counter, Verdict: NftDrop, Comment: "drop invalid packets from forwarding to prevent malicious activity"},
+		NftRule{Matches: []NftMatch{stateEstablished}, Statements: counter, Verdict: NftAccept, Comment: "stateful forward"},
+		NftRule{Matches: []NftMatch{nftMatch("tcp dport", "bgp"), nftMatch("ct state", "new")}, Statements: counter, Verdict: NftJump("refuse"), Comment: "block bgp forward to machines"},
+	)
+	err := addFirewallRules(t, forward, c)
+	if err != nil {
+		return err
+	}
+	for _, f := range c.Networker.PortForwards {
+		forward.Add(f.forwardRule())
+	}
+	if forwardPolicy == ForwardPolicyDrop {
+		forward.Add(NftRule{Statements: refuseLog})
+	}
+
+	output := t.BaseChain("output", NftHook{Type: "filter", Hook: "output", Priority: "0", Policy: "accept"})
+	output.Add(
+		NftRule{Matches: []NftMatch{icmpv6}, Statements: counter, Verdict: NftAccept, Comment: "icmpv6 output required for neighbor discovery"},
+		NftRule{Matches: []NftMatch{nftIfname("oifname", "lo")}, Statements: counter, Verdict: NftAccept, Comment: "lo output required e.g. for chrony"},
+	)
+	for _, lan := range lans {
+		output.Add(NftRule{Matches: append([]NftMatch{nftIfname("oifname", lan)}, bgpUnnumbered...), Statements: counter, Verdict: NftAccept, Comment: "bgp unnumbered output at " + lan})
+	}
+	for _, af := range []string{"ip", "ip6"} {
+		if prefixes := filterAddressFamily(underlay, af); len(prefixes) > 0 {
+			output.Add(NftRule{Matches: []NftMatch{nftMatch(af+" daddr", prefixes...), nftMatch("udp dport", "4789")}, Statements: counter, Verdict: NftAccept, Comment: "outgoing VXLAN"})
+		}
+	}
+	output.Add(
+		NftRule{Matches: []NftMatch{stateEstablished}, Statements: counter, Verdict: NftAccept, Comment: "stateful output"},
+		NftRule{Matches: []NftMatch{stateInvalid}, Statements: counter, Verdict: NftDrop, Comment: "drop invalid packets"},
+	)
+
+	outputCT := t.BaseChain("output_ct", NftHook{Type: "filter", Hook: "output", Priority: "raw", Policy: "accept"})
+	for _, z := range getConntrackZones(c, dnat) {
+		outputCT.Add(z.rules("oifname", "sport")...)
+	}
+
+	refuse := t.Chain("refuse")
+	refuse.Add(
+		NftRule{Statements: refuseLog},
+		NftRule{Statements: counter, Verdict: NftDrop},
+	)
+
+	return nil
+}
+
+// getUnderlayPrefixes returns the prefixes of the underlay network, which contain the VXLAN tunnel endpoints.
+func getUnderlayPrefixes(c config) []string {
+	underlay := c.GetNetworks(mn.Underlay)
+	if len(underlay) == 0 || len(underlay[0].Prefixes) == 0 {
+		return defaultUnderlayPrefixes
 	}
 
-	return net.NewNetworkApplier(data, validator, &NftablesReloader{})
+	return underlay[0].Prefixes
+}
+
+// addNatTable adds the NAT chains of the firewall to the given table.
+func addNatTable(t *NftTable, c config, snat []SNAT, dnat DNAT) {
+	t.AddSet(NftSet{
+		Name:      "proxy_dns_servers",
+		Type:      "ipv4_addr",
+		Flags:     []string{"interval"},
+		AutoMerge: true,
+		Elements:  getDNSProxyServers(c, "ip"),
+	})
+	if dnat.hasAddressFamily("ip6") {
+		t.AddSet(NftSet{
+			Name:      "proxy_dns_servers_v6",
+			Type:      "ipv6_addr",
+			Flags:     []string{"interval"},
+			AutoMerge: true,
+			Elements:  getDNSProxyServers(c, "ip6"),
+		})
+	}
+
+	prerouting := t.BaseChain("prerouting", NftHook{Type: "nat", Hook: "prerouting", Priority: "0", Policy: "accept"})
+	prerouting.Add(dnat.preroutingRules()...)
+	for _, f := range c.Networker.PortForwards {
+		prerouting.Add(f.preroutingRule())
+	}
+
+	preroutingCT := t.BaseChain("prerouting_ct", NftHook{Type: "filter", Hook: "prerouting", Priority: "raw", Policy: "accept"})
+	for _, z := range getConntrackZones(c, dnat) {
+		preroutingCT.Add(z.rules("iifname", "dport")...)
+	}
+
+	t.BaseChain("input", NftHook{Type: "nat", Hook: "input", Priority: "0", Policy: "accept"})
+	t.BaseChain("output", NftHook{Type: "nat", Hook: "output", Priority: "0", Policy: "accept"})
+
+	postrouting := t.BaseChain("postrouting", NftHook{Type: "nat", Hook: "postrouting", Priority: "0", Policy: "accept"})
+	for _, s := range snat {
+		postrouting.Add(s.rules()...)
+	}
+	for _, f := range c.Networker.PortForwards {
+		if r, ok := f.hairpinRule(c); ok {
+			postrouting.Add(r)
+		}
+	}
 }
 
 func (*NftablesReloader) Reload() error {
@@ -121,72 +335,127 @@ func getInput(c config) Input {
 	return input
 }
 
+// rules returns the input rules that allow the tenant VRFs to scrape the exporters of the firewall.
+func (i Input) rules() []NftRule {
+	var result []NftRule
+
+	for _, iface := range i.InInterfaces {
+		for _, e := range []struct{ port, comment string }{{"9100", "node metrics"}, {"9630", "nftables metrics"}} {
+			result = append(result, NftRule{
+				Matches:    []NftMatch{nftIfname("iifname", iface), nftMatch("tcp dport", e.port)},
+				Statements: []NftStatement{NftCounter{}},
+				Verdict:    NftAccept,
+				Comment:    e.comment,
+			})
+		}
+	}
+
+	return result
+}
+
 func getSNAT(c config, enableDNSProxy bool) []SNAT {
 	var result []SNAT
 
-	private := c.getPrivatePrimaryNetwork()
 	networks := c.GetNetworks(mn.PrivatePrimaryUnshared, mn.PrivatePrimaryShared, mn.PrivateSecondaryShared, mn.External)
+	privatePfx := getSNATPrefixes(c)
 
-	privatePfx := private.Prefixes
-	for _, n := range c.Networks {
-		if isDMZNetwork(n) {
-			privatePfx = append(privatePfx, n.Prefixes...)
+	var defaultAddrs []AddrSpec
+	defaultNetworkName, err := c.getDefaultRouteVRFName()
+	if err == nil {
+		defaultAddrs = getAddressPerFamily(c.GetDefaultRouteNetwork().Ips)
+	}
+	outIntSpecs := func(n *models.V1MachineNetwork) []AddrSpec {
+		if enableDNSProxy && (vrfNameOf(n) == defaultNetworkName) {
+			return defaultAddrs
 		}
-
+		return nil
 	}
 
-	var (
-		defaultNetwork models.V1MachineNetwork
-		defaultAF      string
-	)
-	defaultNetworkName, err := c.getDefaultRouteVRFName()
-	if err == nil {
-		defaultNetwork = *c.GetDefaultRouteNetwork()
-		ip, _ := netip.ParseAddr(defaultNetwork.Ips[0])
-		defaultAF = "ip"
-		if ip.Is6() {
-			defaultAF = "ip6"
+	// static snat precedes the masquerading of the same sources
+	for _, s := range c.Networker.SNAT {
+		n := c.getExternalNetwork(s.Network)
+		if n == nil {
+			continue
 		}
+		snat := s.snat(c, n)
+		snat.OutIntSpecs = outIntSpecs(n)
+		result = append(result, snat)
 	}
+
 	for _, n := range networks {
 		if n.Nat != nil && !*n.Nat {
 			continue
 		}
 
-		var sources []AddrSpec
-		cmt := fmt.Sprintf("snat (networkid: %s)", *n.Networkid)
-		svi := fmt.Sprintf("vlan%d", *n.Vrf)
+		result = append(result, SNAT{
+			Comment:      fmt.Sprintf("snat (networkid: %s)", *n.Networkid),
+			OutInterface: fmt.Sprintf("vlan%d", *n.Vrf),
+			OutIntSpecs:  outIntSpecs(n),
+			SourceSpecs:  getSourceSpecs(privatePfx),
+		})
+	}
 
-		for _, p := range privatePfx {
-			af, err := getAddressFamily(p)
-			if err != nil {
+	return result
+}
+
+// getSNATPrefixes returns the prefixes that are translated when leaving the firewall, these are the prefixes of the
+// private primary network and of the DMZ networks.
+func getSNATPrefixes(c config) []string {
+	privatePfx := slices.Clone(c.getPrivatePrimaryNetwork().Prefixes)
+	for _, n := range c.Networks {
+		if isDMZNetwork(n) {
+			privatePfx = append(privatePfx, n.Prefixes...)
+		}
+	}
+
+	return privatePfx
+}
+
+func getSourceSpecs(prefixes []string) []AddrSpec {
+	var result []AddrSpec
+	for _, p := range prefixes {
+		af, err := getAddressFamily(p)
+		if err != nil {
+			continue
+		}
+		result = append(result, AddrSpec{Address: p, AddressFamily: af})
+	}
+
+	return result
+}
+
+// rules returns the postrouting rules that masquerade the source prefixes at the outgoing interface or translate them
+// to the given addresses. Sources of an address family without addresses to translate to are skipped.
+func (s SNAT) rules() []NftRule {
+	var result []NftRule
+
+	for _, src := range s.SourceSpecs {
+		var statement NftStatement = NftMasquerade{Random: true}
+		if len(s.To) > 0 {
+			to := filterIPAddressFamily(s.To, src.AddressFamily)
+			if len(to) == 0 {
 				continue
 			}
-			sspec := AddrSpec{
-				Address:       p,
-				AddressFamily: af,
-			}
-			sources = append(sources, sspec)
-		}
-		s := SNAT{
-			Comment:      cmt,
-			OutInterface: svi,
-			SourceSpecs:  sources,
+			statement = NftSNAT{Family: src.AddressFamily, To: to}
 		}
 
-		if enableDNSProxy && (vrfNameOf(n) == defaultNetworkName) {
-			s.OutIntSpec = AddrSpec{
-				AddressFamily: defaultAF,
-				Address:       defaultNetwork.Ips[0],
+		r := NftRule{
+			Matches:    []NftMatch{nftIfname("oifname", s.OutInterface), nftMatch(src.AddressFamily+" saddr", src.Address)},
+			Statements: []NftStatement{NftCounter{}, statement},
+			Comment:    s.Comment,
+		}
+		for _, out := range s.OutIntSpecs {
+			if out.AddressFamily == src.AddressFamily {
+				r.Matches = append(r.Matches, nftNotMatch(src.AddressFamily+" daddr", out.Address))
 			}
 		}
-		result = append(result, s)
+		result = append(result, r)
 	}
 
 	return result
 }
 
-func getDNSProxyDNAT(c config, port, zone string) DNAT {
+func getDNSProxyDNAT(c config, port string) DNAT {
 	networks := c.GetNetworks(mn.PrivatePrimaryUnshared, mn.PrivatePrimaryShared, mn.PrivateSecondaryShared)
 	svis := []string{}
 	for _, n := range networks {
@@ -199,95 +468,525 @@ func getDNSProxyDNAT(c config, port, zone string) DNAT {
 		return DNAT{}
 	}
 
-	ip, _ := netip.ParseAddr(n.Ips[0])
-	af := "ip"
-	saddr := "10.0.0.0/8"
-	daddr := "@proxy_dns_servers"
-	if ip.Is6() {
-		af = "ip6"
-		saddr = "fd00::/8"
-		daddr = "@proxy_dns_servers_v6"
+	var prefixes []string
+	for _, n := range networks {
+		prefixes = append(prefixes, n.Prefixes...)
+	}
+	if len(c.Networker.DNSProxy.SourcePrefixes) > 0 {
+		prefixes = c.Networker.DNSProxy.SourcePrefixes
+	}
+
+	var specs []DNATSpec
+	for _, dest := range getAddressPerFamily(n.Ips) {
+		saddr := filterAddressFamily(prefixes, dest.AddressFamily)
+		if len(saddr) == 0 {
+			c.log.Warn("no dns proxy source prefixes of the address family, dns proxy is not configured for it", "family", dest.AddressFamily)
+			continue
+		}
+
+		daddr := "@proxy_dns_servers"
+		if dest.AddressFamily == "ip6" {
+			daddr = "@proxy_dns_servers_v6"
+		}
+		specs = append(specs, DNATSpec{
+			SAddr:    saddr,
+			DAddr:    daddr,
+			DestSpec: dest,
+		})
+	}
+	if len(specs) == 0 {
+		return DNAT{}
 	}
+
 	return DNAT{
 		Comment:      "dnat to dns proxy",
 		InInterfaces: svis,
-		SAddr:        saddr,
-		DAddr:        daddr,
 		Port:         port,
-		Zone:         zone,
-		DestSpec: AddrSpec{
-			AddressFamily: af,
-			Address:       n.Ips[0],
-		},
+		Specs:        specs,
 	}
 }
 
-func getFirewallRules(c config) FirewallRules {
-	if c.FirewallRules == nil {
-		return FirewallRules{}
+// getAddressPerFamily returns the first of the given addresses of each address family.
+func getAddressPerFamily(ips []string) []AddrSpec {
+	var result []AddrSpec
+	for _, s := range ips {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		af := "ip"
+		if ip.Is6() {
+			af = "ip6"
+		}
+		if slices.ContainsFunc(result, func(a AddrSpec) bool { return a.AddressFamily == af }) {
+			continue
+		}
+		result = append(result, AddrSpec{AddressFamily: af, Address: s})
 	}
-	var (
-		egressRules           = []string{"# egress rules specified during firewall creation"}
-		ingressRules          = []string{"# ingress rules specified during firewall creation"}
-		inputInterfaces       = getInput(c)
-		quotedInputInterfaces []string
-	)
-	for _, i := range inputInterfaces.InInterfaces {
-		quotedInputInterfaces = append(quotedInputInterfaces, "\""+i+"\"")
+
+	return result
+}
+
+// hasAddressFamily returns true if the DNAT has a destination of the given address family.
+func (d DNAT) hasAddressFamily(af string) bool {
+	return slices.ContainsFunc(d.Specs, func(s DNATSpec) bool { return s.DestSpec.AddressFamily == af })
+}
+
+// getDNSProxyServers returns the upstream resolvers of the given address family whose traffic is redirected to the DNS
+// proxy. The dns servers of the installer configuration take precedence over the default resolvers.
+func getDNSProxyServers(c config, af string) []string {
+	servers := defaultDNSProxyServers
+	if len(c.DNSServers) > 0 {
+		servers = nil
+		for _, s := range c.DNSServers {
+			if s != nil && s.IP != nil {
+				servers = append(servers, *s.IP)
+			}
+		}
 	}
 
-	for _, r := range c.FirewallRules.Egress {
-		ports := make([]string, len(r.Ports))
-		for i, v := range r.Ports {
-			ports[i] = strconv.Itoa(int(v))
+	var result []string
+	for _, s := range servers {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		if ip.Is6() == (af == "ip6") {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// filterAddressFamily returns the prefixes of the given address family, invalid prefixes are skipped.
+func filterAddressFamily(prefixes []string, af string) []string {
+	var result []string
+	for _, p := range prefixes {
+		family, err := getAddressFamily(p)
+		if err != nil || family != af {
+			continue
+		}
+		result = append(result, p)
+	}
+
+	return result
+}
+
+// filterIPAddressFamily returns the IPs of the given address family.
+func filterIPAddressFamily(ips []string, af string) []string {
+	var result []string
+	for _, s := range ips {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || ip.Is6() != (af == "ip6") {
+			continue
+		}
+		result = append(result, s)
+	}
+
+	return result
+}
+
+// protocols are the transport protocols DNAT is configured for.
+var protocols = []string{"tcp", "udp"}
+
+// inputRules returns the input rules that accept the DNAT-ed traffic at the destination.
+func (d DNAT) inputRules() []NftRule {
+	var result []NftRule
+
+	for _, spec := range d.Specs {
+		af := spec.DestSpec.AddressFamily
+		for _, proto := range protocols {
+			result = append(result, NftRule{
+				Matches: []NftMatch{
+					nftMatch(af+" saddr", spec.SAddr...),
+					nftMatch(proto+" dport", d.Port),
+					nftMatch(af+" daddr", spec.DestSpec.Address),
+				},
+				Verdict: NftAccept,
+				Comment: d.Comment,
+			})
+		}
+	}
+
+	return result
+}
+
+// preroutingRules returns the prerouting rules that rewrite the destination of matching traffic.
+func (d DNAT) preroutingRules() []NftRule {
+	var result []NftRule
+
+	for _, spec := range d.Specs {
+		af := spec.DestSpec.AddressFamily
+		for _, iface := range d.InInterfaces {
+			for _, proto := range protocols {
+				var matches []NftMatch
+				if spec.DAddr != "" {
+					matches = append(matches, nftMatch(af+" daddr", spec.DAddr))
+				}
+				matches = append(matches, nftIfname("iifname", iface), nftMatch(proto+" dport", d.Port))
+
+				result = append(result, NftRule{
+					Matches:    matches,
+					Statements: []NftStatement{NftDNAT{Family: af, To: spec.DestSpec.Address}},
+					Comment:    d.Comment,
+				})
+			}
+		}
+	}
+
+	return result
+}
+
+// addFirewallRules adds the firewall rules of the installer configuration. Rules are grouped by direction, protocol
+// and port: the forward chain looks up the chain of a port in a verdict map and that chain matches the addresses of
+// all rules allowing the port with named interval sets. Rules only share a set if their comment, ports, options,
+// destination and address family are equal, a port chain holds one rule per such group. Evaluation is therefore linear
+// in the number of groups allowing a port, but independent of the number of addresses.
+// Rules of other protocols than tcp and udp are dispatched into a single chain per protocol. Rules with a limit or a
+// connection limit are not grouped, each of them gets a chain of its own that is jumped to before the dispatch.
+func addFirewallRules(t *NftTable, forward *NftChain, c config) error {
+	egressRules, ingressRules := getFirewallRules(c)
+
+	egress := newFirewallRuleGroups("egress")
+	for i, r := range egressRules {
+		options := r.options(egress.direction, i)
+		if options.limited() {
+			err := egress.addLimited(r, options, nil, "daddr", r.To)
+			if err != nil {
+				return fmt.Errorf("egress firewall rule %d: %w", i, err)
+			}
+			continue
 		}
+
 		for _, daddr := range r.To {
 			af, err := getAddressFamily(daddr)
 			if err != nil {
 				continue
 			}
-			egressRules = append(egressRules,
-				fmt.Sprintf("iifname { %s } %s daddr %s %s dport { %s } counter accept comment %q", strings.Join(quotedInputInterfaces, ","), af, daddr, strings.ToLower(r.Protocol), strings.Join(ports, ","), r.Comment))
+			err = egress.add(r, options, nil, af+" daddr", daddr)
+			if err != nil {
+				return fmt.Errorf("egress firewall rule %d: %w", i, err)
+			}
 		}
 	}
+	inputInterfaces := nftIfname("iifname", getInput(c).InInterfaces...)
+	egress.addTo(t, forward, &inputInterfaces)
 
+	var outputInterfaces *NftMatch
 	privatePrimaryNetwork := c.getPrivatePrimaryNetwork()
-	outputInterfacenames := ""
 	if privatePrimaryNetwork != nil && privatePrimaryNetwork.Vrf != nil {
-		outputInterfacenames = fmt.Sprintf("oifname { \"vrf%d\", \"vni%d\", \"vlan%d\" }", *privatePrimaryNetwork.Vrf, *privatePrimaryNetwork.Vrf, *privatePrimaryNetwork.Vrf)
+		vrf := *privatePrimaryNetwork.Vrf
+		m := nftIfname("oifname", fmt.Sprintf("vrf%d", vrf), fmt.Sprintf("vni%d", vrf), fmt.Sprintf("vlan%d", vrf))
+		outputInterfaces = &m
 	}
 
-	for _, r := range c.FirewallRules.Ingress {
-		ports := make([]string, len(r.Ports))
-		for i, v := range r.Ports {
-			ports[i] = strconv.Itoa(int(v))
-		}
-		destinationSpec := ""
+	ingress := newFirewallRuleGroups("ingress")
+	for i, r := range ingressRules {
+		var destination NftMatch
 		if len(r.To) > 0 {
-			af, err := getAddressFamily(r.To[0]) // To is validated to contain no mixed addressfamilies in metal-api
+			af, err := getAddressFamily(r.To[0]) // To is validated to contain no mixed addressfamilies
 			if err != nil {
 				continue
 			}
-			destinationSpec = fmt.Sprintf("%s daddr { %s }", af, strings.Join(r.To, ", "))
-		} else if outputInterfacenames != "" {
-			destinationSpec = outputInterfacenames
+			destination = nftMatch(af+" daddr", r.To...)
+		} else if outputInterfaces != nil {
+			destination = *outputInterfaces
 		} else {
 			c.log.Warn("no to address specified but not private primary network present, skipping this rule", "rule", r)
 			continue
 		}
 
+		options := r.options(ingress.direction, i)
+		if options.limited() {
+			err := ingress.addLimited(r, options, &destination, "saddr", r.From)
+			if err != nil {
+				return fmt.Errorf("ingress firewall rule %d: %w", i, err)
+			}
+			continue
+		}
+
 		for _, saddr := range r.From {
 			af, err := getAddressFamily(saddr)
 			if err != nil {
 				continue
 			}
-			ingressRules = append(ingressRules, fmt.Sprintf("%s %s saddr %s %s dport { %s } counter accept comment %q", destinationSpec, af, saddr, strings.ToLower(r.Protocol), strings.Join(ports, ","), r.Comment))
+			err = ingress.add(r, options, &destination, af+" saddr", saddr)
+			if err != nil {
+				return fmt.Errorf("ingress firewall rule %d: %w", i, err)
+			}
 		}
 	}
-	return FirewallRules{
-		Egress:  egressRules,
-		Ingress: ingressRules,
+	ingress.addTo(t, forward, nil)
+
+	return nil
+}
+
+func newFirewallRuleGroups(direction string) *firewallRuleGroups {
+	return &firewallRuleGroups{
+		direction: direction,
+		groups:    map[string][]*firewallRuleGroup{},
+	}
+}
+
+// add allows the given address for the ports or ICMP types of the rule. Only rules with equal options and comments
+// share a group. Invalid or missing ports are an error, skipping them could allow all ports.
+func (g *firewallRuleGroups) add(r firewallRule, options firewallRuleOptions, destination *NftMatch, left, address string) error {
+	protocol := r.protocol()
+
+	ports, err := r.portRanges()
+	if err != nil {
+		return err
 	}
+
+	types := slices.Clone(r.ICMPTypes)
+	slices.Sort(types)
+	types = slices.Compact(types)
+
+	if !slices.Contains(g.protocols, protocol) {
+		g.protocols = append(g.protocols, protocol)
+	}
+
+	i := slices.IndexFunc(g.groups[protocol], func(grp *firewallRuleGroup) bool {
+		return slices.Equal(grp.ports, ports) && slices.Equal(grp.types, types) && grp.left == left &&
+			grp.options == options && grp.comment == r.Comment && reflect.DeepEqual(grp.destination, destination)
+	})
+	if i < 0 {
+		g.groups[protocol] = append(g.groups[protocol], &firewallRuleGroup{ports: ports, types: types,
+			destination: destination, left: left, options: options, comment: r.Comment})
+		i = len(g.groups[protocol]) - 1
+	}
+
+	grp := g.groups[protocol][i]
+	if !slices.Contains(grp.addresses, address) {
+		grp.addresses = append(grp.addresses, address)
+	}
+
+	return nil
+}
+
+// addLimited allows the given addresses for the ports or ICMP types of a rule with a limit or a connection limit.
+// Invalid or missing ports are an error, skipping them could allow all ports.
+func (g *firewallRuleGroups) addLimited(r firewallRule, options firewallRuleOptions, destination *NftMatch, side string, addresses []string) error {
+	ports, err := r.portRanges()
+	if err != nil {
+		return err
+	}
+
+	types := slices.Clone(r.ICMPTypes)
+	slices.Sort(types)
+	types = slices.Compact(types)
+
+	l := limitedFirewallRule{
+		protocol:    r.protocol(),
+		ports:       mergePortRanges(ports),
+		types:       types,
+		destination: destination,
+		side:        side,
+		addresses:   map[string][]string{},
+		options:     options,
+		comment:     r.Comment,
+	}
+	for _, address := range addresses {
+		af, err := getAddressFamily(address)
+		if err != nil {
+			continue
+		}
+		if !slices.Contains(l.addresses[af], address) {
+			l.addresses[af] = append(l.addresses[af], address)
+		}
+	}
+	g.limited = append(g.limited, l)
+
+	return nil
+}
+
+// addTo adds the sets, maps and chains of the firewall rules to the table and the rules dispatching into them to the
+// forward chain. Every group gets a named set of its addresses. Only packets matching the given interface match are
+// dispatched.
+func (g *firewallRuleGroups) addTo(t *NftTable, forward *NftChain, interfaces *NftMatch) {
+	var dispatch []NftMatch
+	if interfaces != nil {
+		dispatch = append(dispatch, *interfaces)
+	}
+
+	for i, l := range g.limited {
+		l.addTo(t, forward, dispatch, fmt.Sprintf("%s_limit_%d", g.direction, i))
+	}
+
+	for _, protocol := range g.protocols {
+		groups := g.groups[protocol]
+
+		rules := make([]NftRule, 0, len(groups))
+		for i, grp := range groups {
+			set := NftSet{
+				Name:      fmt.Sprintf("%s_%s_addresses_%d", g.direction, protocol, i),
+				Type:      "ipv4_addr",
+				Flags:     []string{"interval"},
+				AutoMerge: true,
+				Elements:  grp.addresses,
+			}
+			if strings.HasPrefix(grp.left, "ip6 ") {
+				set.Type = "ipv6_addr"
+			}
+			t.AddSet(set)
+
+			var matches []NftMatch
+			if grp.destination != nil {
+				matches = append(matches, *grp.destination)
+			}
+			if len(grp.types) > 0 {
+				matches = append(matches, nftMatch(protocol+" type", grp.types...))
+			}
+			rules = append(rules, NftRule{
+				Matches:    append(matches, nftMatch(grp.left, "@"+set.Name)),
+				Statements: grp.options.statements(),
+				Verdict:    NftAccept,
+				Comment:    grp.comment,
+			})
+		}
+
+		if protocol == protocolTCP || protocol == protocolUDP {
+			g.addPortRules(t, forward, dispatch, protocol, rules)
+			continue
+		}
+
+		chain := t.Chain(fmt.Sprintf("%s_%s", g.direction, protocol))
+		chain.Add(rules...)
+
+		matches := slices.Clone(dispatch)
+		switch protocol {
+		case protocolICMP:
+			matches = append(matches, nftMatch("meta l4proto", "icmp"))
+		case protocolICMPv6:
+			matches = append(matches, nftMatch("meta l4proto", "ipv6-icmp"))
+		}
+		forward.Add(NftRule{Matches: matches, Verdict: NftJump(chain.Name)})
+	}
+}
+
+// addTo adds the chain with the limited rule and the rules jumping into it to the forward chain, one per address
+// family. The limit is evaluated in the chain, so all ports and address families share it.
+func (l limitedFirewallRule) addTo(t *NftTable, forward *NftChain, dispatch []NftMatch, name string) {
+	chain := t.Chain(name)
+	chain.Add(NftRule{Statements: l.options.statements(), Verdict: NftAccept, Comment: l.comment})
+
+	matches := slices.Clone(dispatch)
+	switch l.protocol {
+	case protocolAny:
+	case protocolICMPv6:
+		matches = append(matches, nftMatch("meta l4proto", "ipv6-icmp"))
+	default:
+		matches = append(matches, nftMatch("meta l4proto", l.protocol))
+	}
+	if len(l.ports) > 0 {
+		var ports []string
+		for _, p := range l.ports {
+			ports = append(ports, p.String())
+		}
+		matches = append(matches, nftMatch(l.protocol+" dport", ports...))
+	}
+	if len(l.types) > 0 {
+		matches = append(matches, nftMatch(l.protocol+" type", l.types...))
+	}
+	if l.destination != nil {
+		matches = append(matches, *l.destination)
+	}
+
+	for _, af := range []string{"ip", "ip6"} {
+		addresses := l.addresses[af]
+		if len(addresses) == 0 {
+			continue
+		}
+
+		set := NftSet{
+			Name:      fmt.Sprintf("%s_%s_addresses", name, af),
+			Type:      "ipv4_addr",
+			Flags:     []string{"interval"},
+			AutoMerge: true,
+			Elements:  addresses,
+		}
+		if af == "ip6" {
+			set.Type = "ipv6_addr"
+		}
+		t.AddSet(set)
+
+		forward.Add(NftRule{
+			Matches: append(slices.Clone(matches), nftMatch(af+" "+l.side, "@"+set.Name)),
+			Verdict: NftJump(chain.Name),
+		})
+	}
+}
+
+// addPortRules adds the rules of the groups of a transport protocol. Ports are split into disjoint ranges, every range
+// gets a chain with the rules of all groups allowing it and the forward chain looks up the chain in a verdict map.
+func (g *firewallRuleGroups) addPortRules(t *NftTable, forward *NftChain, dispatch []NftMatch, protocol string, rules []NftRule) {
+	groups := g.groups[protocol]
+
+	var ports []portRange
+	anyPort := false
+	for _, grp := range groups {
+		ports = append(ports, grp.ports...)
+		anyPort = anyPort || len(grp.ports) == 0
+	}
+	segments := portSegments(ports)
+
+	chainName := func(port string) string {
+		return fmt.Sprintf("%s_%s_%s", g.direction, protocol, port)
+	}
+	segmentChainName := func(s portRange) string {
+		return chainName(strings.ReplaceAll(s.String(), "-", "_"))
+	}
+
+	var vmap []string
+	interval := false
+	for _, s := range segments {
+		t.Chain(segmentChainName(s))
+		vmap = append(vmap, fmt.Sprintf("%s : jump %s", s, segmentChainName(s)))
+		interval = interval || s.from != s.to
+	}
+	if anyPort {
+		t.Chain(chainName("any"))
+	}
+
+	for i, grp := range groups {
+		if len(grp.ports) == 0 {
+			t.Chain(chainName("any")).Add(rules[i])
+		}
+		for _, s := range segments {
+			if slices.ContainsFunc(grp.ports, func(p portRange) bool { return p.contains(s) }) {
+				t.Chain(segmentChainName(s)).Add(rules[i])
+			}
+		}
+	}
+
+	if len(vmap) > 0 {
+		name := fmt.Sprintf("%s_%s", g.direction, protocol)
+		set := NftSet{Name: name, Type: "inet_service", DataType: "verdict", Elements: vmap}
+		if interval {
+			set.Flags = []string{"interval"}
+		}
+		t.AddSet(set)
+		forward.Add(NftRule{
+			Matches:    dispatch,
+			Statements: []NftStatement{NftVerdictMap{Left: protocol + " dport", Map: "@" + name}},
+		})
+	}
+	if anyPort {
+		forward.Add(NftRule{
+			Matches: append(slices.Clone(dispatch), nftMatch("meta l4proto", protocol)),
+			Verdict: NftJump(chainName("any")),
+		})
+	}
+}
+
+func portStrings(ports []int32) []string {
+	result := make([]string, len(ports))
+	for i, p := range ports {
+		result[i] = strconv.Itoa(int(p))
+	}
+
+	return result
 }
 
 func getAddressFamily(p string) (string, error) {
@@ -0,0 +1,1196 @@
+package netconf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	osexec "os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/metal-stack/metal-networker/pkg/exec"
+	"golang.org/x/sys/unix"
+)
+
+type (
+	// NftablesNetlinkValidator validates nftables rules by translating them into netlink messages without sending them.
+	// The translation does not check the rules against the kernel, so the rendered rules are checked with nft --check
+	// in addition if nft is installed.
+	NftablesNetlinkValidator struct {
+		ruleset NftRuleset
+		// path is the file the rules are rendered to, it is not checked with nft --check if empty.
+		path string
+		log  *slog.Logger
+	}
+
+	// NftablesNetlinkReloader loads nftables rules via netlink. All tables of the ruleset are replaced in a single
+	// atomic batch, tables not contained in the ruleset are left untouched.
+	NftablesNetlinkReloader struct {
+		ruleset NftRuleset
+		// path is the file the rules are written to, it is loaded with nft when a transaction is rolled back.
+		path string
+		log  *slog.Logger
+		// conn opens the netlink connection, nftables.New is used if nil.
+		conn func() (*nftables.Conn, error)
+	}
+
+	// nftNetlinkTable is a table of a ruleset translated into the structures of the netlink library.
+	nftNetlinkTable struct {
+		table      *nftables.Table
+		sets       []nftNetlinkSet
+		flowtables []*nftables.Flowtable
+		chains     []nftNetlinkChain
+	}
+
+	nftNetlinkSet struct {
+		set      *nftables.Set
+		elements []nftables.SetElement
+	}
+
+	nftNetlinkChain struct {
+		chain *nftables.Chain
+		rules []nftNetlinkRule
+	}
+
+	nftNetlinkRule struct {
+		// sets are the anonymous sets the rule refers to.
+		sets []nftNetlinkSet
+		rule *nftables.Rule
+	}
+
+	// nftSelector describes how the left hand side of a match is loaded into a register.
+	nftSelector struct {
+		// dependency restricts the match to packets the selector applies to, e.g. to IPv4 packets for ip saddr.
+		dependency []expr.Any
+		load       expr.Any
+		datatype   nftables.SetDatatype
+	}
+
+	// nftCompiler translates a ruleset into the structures of the netlink library.
+	nftCompiler struct {
+		setID uint32
+		table *nftables.Table
+		// sets holds the named sets of the table that is currently translated.
+		sets map[string]*nftables.Set
+		// flowtables holds the flowtables of the table that is currently translated.
+		flowtables map[string]*nftables.Flowtable
+	}
+)
+
+var (
+	nftFamilies = map[string]nftables.TableFamily{
+		"inet": nftables.TableFamilyINet,
+		"ip":   nftables.TableFamilyIPv4,
+		"ip6":  nftables.TableFamilyIPv6,
+	}
+
+	nftHooks = map[string]*nftables.ChainHook{
+		"prerouting":  nftables.ChainHookPrerouting,
+		"input":       nftables.ChainHookInput,
+		"forward":     nftables.ChainHookForward,
+		"output":      nftables.ChainHookOutput,
+		"postrouting": nftables.ChainHookPostrouting,
+	}
+
+	nftPriorities = map[string]*nftables.ChainPriority{
+		"raw":    nftables.ChainPriorityRaw,
+		"mangle": nftables.ChainPriorityMangle,
+		"dstnat": nftables.ChainPriorityNATDest,
+		"filter": nftables.ChainPriorityFilter,
+		"srcnat": nftables.ChainPriorityNATSource,
+	}
+
+	nftDatatypes = map[string]nftables.SetDatatype{
+		nftables.TypeIPAddr.Name:      nftables.TypeIPAddr,
+		nftables.TypeIP6Addr.Name:     nftables.TypeIP6Addr,
+		nftables.TypeInetService.Name: nftables.TypeInetService,
+		nftables.TypeInetProto.Name:   nftables.TypeInetProto,
+		nftables.TypeIFName.Name:      nftables.TypeIFName,
+		nftables.TypeICMPType.Name:    nftables.TypeICMPType,
+		nftables.TypeICMP6Type.Name:   nftables.TypeICMP6Type,
+	}
+
+	// nftServices are the service names of /etc/services used by the rules.
+	nftServices = map[string]uint16{
+		"ssh":    22,
+		"domain": 53,
+		"http":   80,
+		"bgp":    179,
+		"https":  443,
+	}
+
+	nftProtocols = map[string]byte{
+		"icmp":      unix.IPPROTO_ICMP,
+		"tcp":       unix.IPPROTO_TCP,
+		"udp":       unix.IPPROTO_UDP,
+		"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	}
+
+	nftCTStates = map[string]uint32{
+		"invalid":     expr.CtStateBitINVALID,
+		"established": expr.CtStateBitESTABLISHED,
+		"related":     expr.CtStateBitRELATED,
+		"new":         expr.CtStateBitNEW,
+		"untracked":   expr.CtStateBitUNTRACKED,
+	}
+
+	// nftCTStatus are the bits of the conntrack status, see enum ip_conntrack_status of the kernel.
+	nftCTStatus = map[string]uint32{
+		"expected":   1 << 0,
+		"seen-reply": 1 << 1,
+		"assured":    1 << 2,
+		"confirmed":  1 << 3,
+		"snat":       1 << 4,
+		"dnat":       1 << 5,
+		"dying":      1 << 9,
+	}
+
+	nftSelectors = map[string]nftSelector{
+		"iifname":      {load: &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1}, datatype: nftables.TypeIFName},
+		"oifname":      {load: &expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1}, datatype: nftables.TypeIFName},
+		"meta l4proto": {load: &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1}, datatype: nftables.TypeInetProto},
+		"ct state":     {load: &expr.Ct{Key: expr.CtKeySTATE, Register: 1}, datatype: nftables.TypeCTState},
+		"ct status":    {load: &expr.Ct{Key: expr.CtKeySTATUS, Register: 1}, datatype: nftables.TypeCTStatus},
+		"ip saddr":     nftNetworkSelector(unix.NFPROTO_IPV4, 12, nftables.TypeIPAddr),
+		"ip daddr":     nftNetworkSelector(unix.NFPROTO_IPV4, 16, nftables.TypeIPAddr),
+		"ip6 saddr":    nftNetworkSelector(unix.NFPROTO_IPV6, 8, nftables.TypeIP6Addr),
+		"ip6 daddr":    nftNetworkSelector(unix.NFPROTO_IPV6, 24, nftables.TypeIP6Addr),
+		"tcp sport":    nftTransportSelector(unix.IPPROTO_TCP, 0),
+		"tcp dport":    nftTransportSelector(unix.IPPROTO_TCP, 2),
+		"udp sport":    nftTransportSelector(unix.IPPROTO_UDP, 0),
+		"udp dport":    nftTransportSelector(unix.IPPROTO_UDP, 2),
+		"icmp type":    nftICMPTypeSelector(unix.IPPROTO_ICMP, nftables.TypeICMPType),
+		"icmpv6 type":  nftICMPTypeSelector(unix.IPPROTO_ICMPV6, nftables.TypeICMP6Type),
+	}
+)
+
+func nftNetworkSelector(nfproto byte, offset uint32, datatype nftables.SetDatatype) nftSelector {
+	return nftSelector{
+		dependency: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		},
+		load:     &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: datatype.Bytes},
+		datatype: datatype,
+	}
+}
+
+func nftTransportSelector(l4proto byte, offset uint32) nftSelector {
+	return nftSelector{
+		dependency: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		},
+		load:     &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+		datatype: nftables.TypeInetService,
+	}
+}
+
+func nftICMPTypeSelector(l4proto byte, datatype nftables.SetDatatype) nftSelector {
+	return nftSelector{
+		dependency: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		},
+		load:     &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		datatype: datatype,
+	}
+}
+
+// Validate validates the nftables rules by translating them into netlink messages and checking the rendered rules with
+// nft --check before the tables are replaced by the reloader.
+func (v NftablesNetlinkValidator) Validate() error {
+	_, err := compileNftRuleset(v.ruleset)
+	if err != nil {
+		return err
+	}
+
+	if v.path == "" {
+		return nil
+	}
+	if _, err := osexec.LookPath("nft"); err != nil {
+		v.log.Warn("nft is not installed, the rules are not checked against the kernel before loading them", "error", err)
+		return nil
+	}
+
+	return NftablesValidator{path: v.path, log: v.log}.Validate()
+}
+
+// Reload replaces all tables of the ruleset in a single batch and verifies the result by reading it back.
+func (r NftablesNetlinkReloader) Reload() error {
+	tables, err := compileNftRuleset(r.ruleset)
+	if err != nil {
+		return err
+	}
+
+	newConn := r.conn
+	if newConn == nil {
+		newConn = func() (*nftables.Conn, error) { return nftables.New() }
+	}
+
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+		r.log.Info("replacing nftables table via netlink", "family", t.table.Family, "table", t.table.Name)
+
+		// adding the table before deleting it makes the batch independent of whether the table exists
+		conn.AddTable(t.table)
+		conn.DelTable(t.table)
+		conn.AddTable(t.table)
+
+		for _, f := range t.flowtables {
+			conn.AddFlowtable(f)
+		}
+
+		// chains are added first, elements of verdict maps jump to them
+		for _, c := range t.chains {
+			conn.AddChain(c.chain)
+		}
+
+		for _, s := range t.sets {
+			err := conn.AddSet(s.set, s.elements)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, c := range t.chains {
+			for _, rule := range c.rules {
+				for _, s := range rule.sets {
+					err := conn.AddSet(s.set, s.elements)
+					if err != nil {
+						return err
+					}
+				}
+				conn.AddRule(rule.rule)
+			}
+		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("unable to load nftables rules: %w", err)
+	}
+
+	var errs []error
+	for _, t := range tables {
+		errs = append(errs, t.verify(conn))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Rollback loads the rules file restored by a rolled back transaction with nft, Reload would load the rejected ruleset
+// again. Like on Reload, only the tables of the ruleset are replaced in a single atomic batch. The tables are removed if
+// there was no rules file before.
+func (r NftablesNetlinkReloader) Rollback() error {
+	var b strings.Builder
+	for _, t := range r.ruleset.Tables {
+		// adding the table before deleting it makes the batch independent of whether the table exists
+		fmt.Fprintf(&b, "add table %s %s\ndelete table %s %s\n", t.Family, t.Name, t.Family, t.Name)
+	}
+
+	_, err := os.Stat(r.path)
+	if err == nil {
+		fmt.Fprintf(&b, "include %q\n", r.path)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	f, err := os.CreateTemp("", "nftrollback_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	r.log.Info("loading restored nftables rules with nft", "file", r.path)
+	return exec.NewVerboseCmd("nft", "--file", f.Name()).Run()
+}
+
+// verify checks that the table loaded into the kernel contains the expected sets, chains and rules.
+func (t nftNetlinkTable) verify(conn *nftables.Conn) error {
+	sets, err := conn.GetSets(t.table)
+	if err != nil {
+		return fmt.Errorf("unable to read back sets of table %s: %w", t.table.Name, err)
+	}
+
+	var errs []error
+	for _, s := range t.sets {
+		if !slices.ContainsFunc(sets, func(loaded *nftables.Set) bool { return loaded.Name == s.set.Name }) {
+			errs = append(errs, fmt.Errorf("set %s of table %s was not loaded", s.set.Name, t.table.Name))
+		}
+	}
+
+	if len(t.flowtables) > 0 {
+		flowtables, err := conn.ListFlowtables(t.table)
+		if err != nil {
+			return fmt.Errorf("unable to read back flowtables of table %s: %w", t.table.Name, err)
+		}
+		for _, f := range t.flowtables {
+			if !slices.ContainsFunc(flowtables, func(loaded *nftables.Flowtable) bool { return loaded.Name == f.Name }) {
+				errs = append(errs, fmt.Errorf("flowtable %s of table %s was not loaded", f.Name, t.table.Name))
+			}
+		}
+	}
+
+	chains, err := conn.ListChainsOfTableFamily(t.table.Family)
+	if err != nil {
+		return fmt.Errorf("unable to read back chains of table %s: %w", t.table.Name, err)
+	}
+
+	for _, c := range t.chains {
+		if !slices.ContainsFunc(chains, func(loaded *nftables.Chain) bool {
+			return loaded.Table.Name == t.table.Name && loaded.Name == c.chain.Name
+		}) {
+			errs = append(errs, fmt.Errorf("chain %s of table %s was not loaded", c.chain.Name, t.table.Name))
+			continue
+		}
+
+		rules, err := conn.GetRules(t.table, c.chain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to read back rules of chain %s: %w", c.chain.Name, err))
+			continue
+		}
+		if len(rules) != len(c.rules) {
+			errs = append(errs, fmt.Errorf("chain %s of table %s contains %d rules instead of %d", c.chain.Name,
+				t.table.Name, len(rules), len(c.rules)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// compileNftRuleset translates the given ruleset into the structures of the netlink library.
+func compileNftRuleset(r NftRuleset) ([]nftNetlinkTable, error) {
+	c := &nftCompiler{}
+
+	var (
+		result []nftNetlinkTable
+		errs   []error
+	)
+	for _, t := range r.Tables {
+		table, err := c.compileTable(t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("table %s %s: %w", t.Family, t.Name, err))
+			continue
+		}
+		result = append(result, table)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+func (c *nftCompiler) compileTable(t *NftTable) (nftNetlinkTable, error) {
+	family, ok := nftFamilies[t.Family]
+	if !ok {
+		return nftNetlinkTable{}, fmt.Errorf("unsupported family %q", t.Family)
+	}
+
+	c.table = &nftables.Table{Family: family, Name: t.Name}
+	c.sets = map[string]*nftables.Set{}
+	result := nftNetlinkTable{table: c.table}
+
+	var errs []error
+	for _, s := range t.Sets {
+		set, err := c.compileSet(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("set %s: %w", s.Name, err))
+			continue
+		}
+		c.sets[s.Name] = set.set
+		result.sets = append(result.sets, set)
+	}
+
+	c.flowtables = map[string]*nftables.Flowtable{}
+	for _, f := range t.Flowtables {
+		flowtable, err := c.compileFlowtable(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("flowtable %s: %w", f.Name, err))
+			continue
+		}
+		c.flowtables[f.Name] = flowtable
+		result.flowtables = append(result.flowtables, flowtable)
+	}
+
+	chains := map[string]*nftables.Chain{}
+	for _, ch := range t.Chains {
+		chain, err := c.compileChain(ch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chain %s: %w", ch.Name, err))
+			continue
+		}
+		chains[ch.Name] = chain
+		result.chains = append(result.chains, nftNetlinkChain{chain: chain})
+	}
+
+	for i, ch := range t.Chains {
+		chain, ok := chains[ch.Name]
+		if !ok {
+			continue
+		}
+		for _, r := range ch.Rules {
+			rule, err := c.compileRule(chain, r)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("chain %s: rule %q: %w", ch.Name, r, err))
+				continue
+			}
+			result.chains[i].rules = append(result.chains[i].rules, rule)
+		}
+	}
+
+	return result, errors.Join(errs...)
+}
+
+func (c *nftCompiler) compileSet(s *NftSet) (nftNetlinkSet, error) {
+	datatype, ok := nftDatatypes[s.Type]
+	if !ok {
+		return nftNetlinkSet{}, fmt.Errorf("unsupported type %q", s.Type)
+	}
+
+	c.setID++
+	set := &nftables.Set{
+		Table:     c.table,
+		ID:        c.setID,
+		Name:      s.Name,
+		Interval:  slices.Contains(s.Flags, "interval"),
+		AutoMerge: s.AutoMerge,
+		KeyType:   datatype,
+	}
+
+	if s.DataType != "" {
+		elements, err := nftVerdictMapElements(datatype, set.Interval, s.DataType, s.Elements)
+		if err != nil {
+			return nftNetlinkSet{}, err
+		}
+		set.IsMap = true
+		set.DataType = nftables.TypeVerdict
+
+		return nftNetlinkSet{set: set, elements: elements}, nil
+	}
+
+	elements, err := nftSetElements(datatype, set.Interval, s.Elements)
+	if err != nil {
+		return nftNetlinkSet{}, err
+	}
+
+	return nftNetlinkSet{set: set, elements: elements}, nil
+}
+
+// nftVerdictMapElements returns the elements of a verdict map given as "key : verdict".
+func nftVerdictMapElements(datatype nftables.SetDatatype, interval bool, dataType string, values []string) ([]nftables.SetElement, error) {
+	if dataType != "verdict" {
+		return nil, fmt.Errorf("unsupported map data type %q", dataType)
+	}
+
+	type element struct {
+		first, last []byte
+		verdict     *expr.Verdict
+	}
+
+	var elements []element
+	for _, v := range values {
+		key, verdict, ok := strings.Cut(v, " : ")
+		if !ok {
+			return nil, fmt.Errorf("invalid map element %q", v)
+		}
+
+		first, last, err := nftInterval(datatype, key)
+		if err != nil {
+			return nil, err
+		}
+		if !interval && !slices.Equal(first, last) {
+			return nil, fmt.Errorf("%q requires a map with interval flag", key)
+		}
+
+		e, err := compileNftVerdict(NftVerdict(verdict))
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, element{first: first, last: last, verdict: e})
+	}
+
+	if !interval {
+		result := make([]nftables.SetElement, 0, len(elements))
+		for _, e := range elements {
+			result = append(result, nftables.SetElement{Key: e.first, VerdictData: e.verdict})
+		}
+		return result, nil
+	}
+
+	// the intervals of a map can not be merged as they map to different verdicts
+	slices.SortFunc(elements, func(a, b element) int {
+		return bytes.Compare(a.first, b.first)
+	})
+
+	var result []nftables.SetElement
+	for i, e := range elements {
+		if i > 0 && bytes.Compare(e.first, elements[i-1].last) <= 0 {
+			return nil, fmt.Errorf("map elements must not overlap: %q", values)
+		}
+		result = append(result, nftables.SetElement{Key: e.first, VerdictData: e.verdict})
+
+		// the end of an interval is implied by the start of an adjacent one
+		end, ok := nftNext(e.last)
+		if ok && (i+1 == len(elements) || !bytes.Equal(end, elements[i+1].first)) {
+			result = append(result, nftables.SetElement{Key: end, IntervalEnd: true})
+		}
+	}
+
+	return result, nil
+}
+
+func (c *nftCompiler) compileFlowtable(f *NftFlowtable) (*nftables.Flowtable, error) {
+	priority := nftables.FlowtablePriorityFilter
+	if f.Priority != "filter" {
+		p, err := strconv.ParseInt(f.Priority, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported priority %q", f.Priority)
+		}
+		priority = nftables.FlowtablePriorityRef(nftables.FlowtablePriority(p))
+	}
+
+	if len(f.Devices) == 0 {
+		return nil, errors.New("flowtable has no devices")
+	}
+
+	flowtable := &nftables.Flowtable{
+		Table:    c.table,
+		Name:     f.Name,
+		Hooknum:  nftables.FlowtableHookIngress,
+		Priority: priority,
+		Devices:  f.Devices,
+	}
+	if f.Offload {
+		flowtable.Flags = nftables.FlowtableFlagsHWOffload
+	}
+
+	return flowtable, nil
+}
+
+func (c *nftCompiler) compileChain(ch *NftChain) (*nftables.Chain, error) {
+	chain := &nftables.Chain{Table: c.table, Name: ch.Name}
+	if ch.Hook == nil {
+		return chain, nil
+	}
+
+	hook, ok := nftHooks[ch.Hook.Hook]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hook %q", ch.Hook.Hook)
+	}
+
+	priority, ok := nftPriorities[ch.Hook.Priority]
+	if !ok {
+		p, err := strconv.ParseInt(ch.Hook.Priority, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported priority %q", ch.Hook.Priority)
+		}
+		priority = nftables.ChainPriorityRef(nftables.ChainPriority(p))
+	}
+
+	var policy nftables.ChainPolicy
+	switch ch.Hook.Policy {
+	case "accept":
+		policy = nftables.ChainPolicyAccept
+	case "drop":
+		policy = nftables.ChainPolicyDrop
+	default:
+		return nil, fmt.Errorf("unsupported policy %q", ch.Hook.Policy)
+	}
+
+	chain.Type = nftables.ChainType(ch.Hook.Type)
+	chain.Hooknum = hook
+	chain.Priority = priority
+	chain.Policy = &policy
+
+	return chain, nil
+}
+
+func (c *nftCompiler) compileRule(chain *nftables.Chain, r NftRule) (nftNetlinkRule, error) {
+	result := nftNetlinkRule{rule: &nftables.Rule{Table: c.table, Chain: chain}}
+
+	for _, m := range r.Matches {
+		exprs, sets, err := c.compileMatch(m)
+		if err != nil {
+			return nftNetlinkRule{}, err
+		}
+		result.rule.Exprs = append(result.rule.Exprs, exprs...)
+		result.sets = append(result.sets, sets...)
+	}
+
+	for _, s := range r.Statements {
+		exprs, sets, err := c.compileStatement(s)
+		if err != nil {
+			return nftNetlinkRule{}, err
+		}
+		result.rule.Exprs = append(result.rule.Exprs, exprs...)
+		result.sets = append(result.sets, sets...)
+	}
+
+	if r.Verdict != "" {
+		verdict, err := compileNftVerdict(r.Verdict)
+		if err != nil {
+			return nftNetlinkRule{}, err
+		}
+		result.rule.Exprs = append(result.rule.Exprs, verdict)
+	}
+
+	if r.Comment != "" {
+		result.rule.UserData = userdata.AppendString(nil, userdata.TypeComment, r.Comment)
+	}
+
+	return result, nil
+}
+
+func (c *nftCompiler) compileMatch(m NftMatch) ([]expr.Any, []nftNetlinkSet, error) {
+	sel, ok := nftSelectors[m.Left]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported match %q", m.Left)
+	}
+
+	var op expr.CmpOp
+	switch m.Op {
+	case "", "==":
+		op = expr.CmpOpEq
+	case "!=":
+		op = expr.CmpOpNeq
+	default:
+		return nil, nil, fmt.Errorf("unsupported operator %q", m.Op)
+	}
+
+	if len(m.Values) == 0 {
+		return nil, nil, fmt.Errorf("match %q has no value", m.Left)
+	}
+
+	exprs := append(slices.Clone(sel.dependency), sel.load)
+
+	if bits, ok := map[string]map[string]uint32{
+		nftables.TypeCTState.Name:  nftCTStates,
+		nftables.TypeCTStatus.Name: nftCTStatus,
+	}[sel.datatype.Name]; ok {
+		var mask uint32
+		for _, v := range m.Values {
+			for _, name := range strings.Split(v, ",") {
+				bit, ok := bits[name]
+				if !ok {
+					return nil, nil, fmt.Errorf("unknown conntrack %s %q", strings.TrimPrefix(m.Left, "ct "), name)
+				}
+				mask |= bit
+			}
+		}
+
+		// the state or status matches if any of its bits is set, which is inverted by !=
+		cmp := expr.CmpOpNeq
+		if op == expr.CmpOpNeq {
+			cmp = expr.CmpOpEq
+		}
+
+		return append(exprs,
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(mask),
+				Xor: make([]byte, 4)},
+			&expr.Cmp{Op: cmp, Register: 1, Data: make([]byte, 4)},
+		), nil, nil
+	}
+
+	if len(m.Values) == 1 && strings.HasPrefix(m.Values[0], "@") {
+		name := strings.TrimPrefix(m.Values[0], "@")
+		set, ok := c.sets[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("set %q is not defined", name)
+		}
+
+		return append(exprs, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID,
+			Invert: op == expr.CmpOpNeq}), nil, nil
+	}
+
+	if len(m.Values) == 1 {
+		cmp, err := nftCompare(sel.datatype, op, m.Values[0])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return append(exprs, cmp...), nil, nil
+	}
+
+	interval := false
+	for _, v := range m.Values {
+		if sel.datatype.Name == nftables.TypeIFName.Name {
+			break
+		}
+		first, last, err := nftInterval(sel.datatype, v)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !slices.Equal(first, last) {
+			interval = true
+		}
+	}
+
+	elements, err := nftSetElements(sel.datatype, interval, m.Values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.setID++
+	set := &nftables.Set{
+		Table:     c.table,
+		ID:        c.setID,
+		Name:      "__set%d",
+		Anonymous: true,
+		Constant:  true,
+		Interval:  interval,
+		KeyType:   sel.datatype,
+	}
+
+	exprs = append(exprs, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID,
+		Invert: op == expr.CmpOpNeq})
+
+	return exprs, []nftNetlinkSet{{set: set, elements: elements}}, nil
+}
+
+// nftCompare compares the register with a single value, which might be a prefix, a range or an interface name with
+// a wildcard.
+func nftCompare(datatype nftables.SetDatatype, op expr.CmpOp, value string) ([]expr.Any, error) {
+	if datatype.Name == nftables.TypeIFName.Name {
+		name := strings.Trim(value, `"`)
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			return []expr.Any{&expr.Cmp{Op: op, Register: 1, Data: []byte(prefix)}}, nil
+		}
+
+		data, err := nftIfnameData(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return []expr.Any{&expr.Cmp{Op: op, Register: 1, Data: data}}, nil
+	}
+
+	first, last, err := nftInterval(datatype, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if slices.Equal(first, last) {
+		return []expr.Any{&expr.Cmp{Op: op, Register: 1, Data: first}}, nil
+	}
+
+	if mask, ok := nftPrefixMask(first, last); ok {
+		return []expr.Any{
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(mask)), Mask: mask,
+				Xor: make([]byte, len(mask))},
+			&expr.Cmp{Op: op, Register: 1, Data: first},
+		}, nil
+	}
+
+	return []expr.Any{&expr.Range{Op: op, Register: 1, FromData: first, ToData: last}}, nil
+}
+
+// nftSetElements returns the elements of a set of the given type. Every element of an interval set is given by its
+// first value and the value following its last value. Overlapping and adjacent intervals are merged like nft does for
+// sets with auto-merge, the kernel rejects overlapping intervals.
+func nftSetElements(datatype nftables.SetDatatype, interval bool, values []string) ([]nftables.SetElement, error) {
+	var (
+		result    []nftables.SetElement
+		intervals [][2][]byte
+	)
+
+	for _, v := range values {
+		if datatype.Name == nftables.TypeIFName.Name {
+			data, err := nftIfnameData(strings.Trim(v, `"`))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nftables.SetElement{Key: data})
+			continue
+		}
+
+		first, last, err := nftInterval(datatype, v)
+		if err != nil {
+			return nil, err
+		}
+
+		if !interval {
+			if !slices.Equal(first, last) {
+				return nil, fmt.Errorf("%q requires a set with interval flag", v)
+			}
+			result = append(result, nftables.SetElement{Key: first})
+			continue
+		}
+
+		intervals = append(intervals, [2][]byte{first, last})
+	}
+
+	for _, i := range nftMergeIntervals(intervals) {
+		result = append(result, nftables.SetElement{Key: i[0]})
+		if end, ok := nftNext(i[1]); ok {
+			result = append(result, nftables.SetElement{Key: end, IntervalEnd: true})
+		}
+	}
+
+	return result, nil
+}
+
+// nftMergeIntervals sorts the given intervals and merges overlapping and adjacent ones.
+func nftMergeIntervals(intervals [][2][]byte) [][2][]byte {
+	slices.SortFunc(intervals, func(a, b [2][]byte) int {
+		return bytes.Compare(a[0], b[0])
+	})
+
+	var result [][2][]byte
+	for _, i := range intervals {
+		if len(result) > 0 {
+			prev := &result[len(result)-1]
+			next, ok := nftNext(prev[1])
+			if !ok || bytes.Compare(i[0], next) <= 0 {
+				if bytes.Compare(i[1], prev[1]) > 0 {
+					prev[1] = i[1]
+				}
+				continue
+			}
+		}
+		result = append(result, i)
+	}
+
+	return result
+}
+
+// nftInterval returns the first and the last value of a single value, a prefix or a range of the given type.
+func nftInterval(datatype nftables.SetDatatype, value string) ([]byte, []byte, error) {
+	switch datatype.Name {
+	case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		is4 := datatype.Name == nftables.TypeIPAddr.Name
+		addr := func(s string) (netip.Addr, error) {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return netip.Addr{}, err
+			}
+			if a.Is4() != is4 {
+				return netip.Addr{}, fmt.Errorf("%s is not of type %s", s, datatype.Name)
+			}
+			return a, nil
+		}
+
+		if strings.Contains(value, "/") {
+			p, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if p.Addr().Is4() != is4 {
+				return nil, nil, fmt.Errorf("%s is not of type %s", value, datatype.Name)
+			}
+			first := p.Masked().Addr().AsSlice()
+			last := slices.Clone(first)
+			for i := p.Bits(); i < len(last)*8; i++ {
+				last[i/8] |= 0x80 >> (i % 8)
+			}
+			return first, last, nil
+		}
+
+		from, to, isRange := strings.Cut(value, "-")
+		first, err := addr(from)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isRange {
+			return first.AsSlice(), first.AsSlice(), nil
+		}
+		last, err := addr(to)
+		if err != nil {
+			return nil, nil, err
+		}
+		return first.AsSlice(), last.AsSlice(), nil
+
+	case nftables.TypeInetService.Name:
+		port := func(s string) ([]byte, error) {
+			if p, ok := nftServices[s]; ok {
+				return binaryutil.BigEndian.PutUint16(p), nil
+			}
+			p, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", s)
+			}
+			return binaryutil.BigEndian.PutUint16(uint16(p)), nil
+		}
+
+		from, to, isRange := strings.Cut(value, "-")
+		first, err := port(from)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isRange {
+			return first, first, nil
+		}
+		last, err := port(to)
+		if err != nil {
+			return nil, nil, err
+		}
+		return first, last, nil
+
+	case nftables.TypeInetProto.Name:
+		if p, ok := nftProtocols[value]; ok {
+			return []byte{p}, []byte{p}, nil
+		}
+		p, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid protocol %q", value)
+		}
+		return []byte{byte(p)}, []byte{byte(p)}, nil
+
+	case nftables.TypeICMPType.Name, nftables.TypeICMP6Type.Name:
+		protocol := protocolICMP
+		if datatype.Name == nftables.TypeICMP6Type.Name {
+			protocol = protocolICMPv6
+		}
+		t, err := parseICMPType(protocol, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []byte{t}, []byte{t}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported type %s", datatype.Name)
+}
+
+// nftPrefixMask returns the mask of the prefix given by its first and last address, it returns false if the interval
+// is not a prefix.
+func nftPrefixMask(first, last []byte) ([]byte, bool) {
+	mask := make([]byte, len(first))
+	for i := range first {
+		mask[i] = ^(first[i] ^ last[i])
+	}
+
+	// the mask must consist of leading ones only and the first address must be the network address
+	hostBits := false
+	for i := 0; i < len(mask)*8; i++ {
+		bit := mask[i/8]&(0x80>>(i%8)) != 0
+		if !bit {
+			hostBits = true
+		} else if hostBits {
+			return nil, false
+		}
+	}
+
+	for i := range first {
+		if first[i]&^mask[i] != 0 || last[i]|mask[i] != 0xff {
+			return nil, false
+		}
+	}
+
+	return mask, true
+}
+
+// nftNext returns the value following the given one, it returns false if there is none.
+func nftNext(b []byte) ([]byte, bool) {
+	result := slices.Clone(b)
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i]++
+		if result[i] != 0 {
+			return result, true
+		}
+	}
+
+	return nil, false
+}
+
+// nftIfnameData returns the interface name as it is compared by the kernel.
+func nftIfnameData(name string) ([]byte, error) {
+	if len(name) >= int(nftables.TypeIFName.Bytes) {
+		return nil, fmt.Errorf("interface name %q is too long", name)
+	}
+
+	data := make([]byte, nftables.TypeIFName.Bytes)
+	copy(data, name)
+
+	return data, nil
+}
+
+// compileStatement translates a statement, it returns the anonymous sets the statement refers to as well.
+func (c *nftCompiler) compileStatement(s NftStatement) ([]expr.Any, []nftNetlinkSet, error) {
+	switch s := s.(type) {
+	case NftCounter:
+		return []expr.Any{&expr.Counter{}}, nil, nil
+
+	case NftLimit:
+		rate, unit, ok := strings.Cut(s.Rate, "/")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid rate %q", s.Rate)
+		}
+		r, err := strconv.ParseUint(rate, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rate %q", s.Rate)
+		}
+		units := map[string]expr.LimitTime{
+			"second": expr.LimitTimeSecond,
+			"minute": expr.LimitTimeMinute,
+			"hour":   expr.LimitTimeHour,
+			"day":    expr.LimitTimeDay,
+		}
+		u, ok := units[unit]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid rate %q", s.Rate)
+		}
+		// nft uses a burst of 5 packets by default
+		return []expr.Any{&expr.Limit{Type: expr.LimitTypePkts, Rate: r, Unit: u, Burst: 5}}, nil, nil
+
+	case NftCTCount:
+		return []expr.Any{&expr.Connlimit{Count: s.Count}}, nil, nil
+
+	case NftLog:
+		return []expr.Any{&expr.Log{Key: 1 << unix.NFTA_LOG_PREFIX, Data: []byte(s.Prefix)}}, nil, nil
+
+	case NftCTZone:
+		zone, err := strconv.ParseUint(s.Zone, 10, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid conntrack zone %q", s.Zone)
+		}
+		return []expr.Any{
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint16(uint16(zone))},
+			&expr.Ct{Key: expr.CtKeyZONE, Register: 1, SourceRegister: true},
+		}, nil, nil
+
+	case NftMasquerade:
+		return []expr.Any{&expr.Masq{Random: s.Random}}, nil, nil
+
+	case NftVerdictMap:
+		sel, ok := nftSelectors[s.Left]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported match %q", s.Left)
+		}
+		name := strings.TrimPrefix(s.Map, "@")
+		set, ok := c.sets[name]
+		if !ok || !set.IsMap {
+			return nil, nil, fmt.Errorf("map %q is not defined", name)
+		}
+		// the verdict is looked up into the verdict register
+		return append(append(slices.Clone(sel.dependency), sel.load),
+			&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: set.Name, SetID: set.ID},
+		), nil, nil
+
+	case NftFlowOffload:
+		if _, ok := c.flowtables[s.Flowtable]; !ok {
+			return nil, nil, fmt.Errorf("flowtable %q is not defined", s.Flowtable)
+		}
+		return []expr.Any{&expr.FlowOffload{Name: s.Flowtable}}, nil, nil
+
+	case NftSNAT:
+		family := uint32(unix.NFPROTO_IPV4)
+		datatype := nftables.TypeIPAddr
+		if s.Family == "ip6" {
+			family = unix.NFPROTO_IPV6
+			datatype = nftables.TypeIP6Addr
+		}
+		if len(s.To) == 0 {
+			return nil, nil, errors.New("snat without address")
+		}
+
+		addrs := make([][]byte, 0, len(s.To))
+		for _, to := range s.To {
+			addr, err := netip.ParseAddr(to)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid snat address %q", to)
+			}
+			if addr.Is4() != (family == unix.NFPROTO_IPV4) {
+				return nil, nil, fmt.Errorf("snat address %s does not belong to family %s", to, s.Family)
+			}
+			addrs = append(addrs, addr.AsSlice())
+		}
+
+		nat := &expr.NAT{Type: expr.NATTypeSourceNAT, Family: family, RegAddrMin: 1}
+		if len(addrs) == 1 {
+			return []expr.Any{&expr.Immediate{Register: 1, Data: addrs[0]}, nat}, nil, nil
+		}
+
+		// the source address is hashed onto the index of the address to use
+		sel := nftSelectors[s.Family+" saddr"]
+		elements := make([]nftables.SetElement, 0, len(addrs))
+		for i, addr := range addrs {
+			elements = append(elements, nftables.SetElement{Key: binaryutil.NativeEndian.PutUint32(uint32(i)), Val: addr})
+		}
+
+		c.setID++
+		set := &nftables.Set{
+			Table:     c.table,
+			ID:        c.setID,
+			Name:      "__map%d",
+			Anonymous: true,
+			Constant:  true,
+			IsMap:     true,
+			KeyType:   nftables.TypeInteger,
+			DataType:  datatype,
+		}
+
+		return append(append(slices.Clone(sel.dependency), sel.load),
+			&expr.Hash{SourceRegister: 1, DestRegister: 1, Length: uint32(len(addrs[0])), Modulus: uint32(len(addrs)),
+				Type: expr.HashTypeJenkins},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: set.Name, SetID: set.ID},
+			nat,
+		), []nftNetlinkSet{{set: set, elements: elements}}, nil
+
+	case NftDNAT:
+		// the destination is either an address or an address with port like 10.0.0.1:80 or [fd00::1]:80
+		to, err := netip.ParseAddrPort(s.To)
+		if err != nil {
+			addr, err := netip.ParseAddr(s.To)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid dnat address %q", s.To)
+			}
+			to = netip.AddrPortFrom(addr, 0)
+		}
+		addr, port := to.Addr(), to.Port()
+		family := uint32(unix.NFPROTO_IPV4)
+		if s.Family == "ip6" {
+			family = unix.NFPROTO_IPV6
+		}
+		if addr.Is4() != (family == unix.NFPROTO_IPV4) {
+			return nil, nil, fmt.Errorf("dnat address %s does not belong to family %s", s.To, s.Family)
+		}
+		if port == 0 {
+			return []expr.Any{
+				&expr.Immediate{Register: 1, Data: addr.AsSlice()},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: family, RegAddrMin: 1},
+			}, nil, nil
+		}
+		return []expr.Any{
+			&expr.Immediate{Register: 1, Data: addr.AsSlice()},
+			&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(port)},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: family, RegAddrMin: 1, RegProtoMin: 2, Specified: true},
+		}, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported statement %T", s)
+}
+
+func compileNftVerdict(v NftVerdict) (*expr.Verdict, error) {
+	switch v {
+	case NftAccept:
+		return &expr.Verdict{Kind: expr.VerdictAccept}, nil
+	case NftDrop:
+		return &expr.Verdict{Kind: expr.VerdictDrop}, nil
+	}
+
+	if chain, ok := strings.CutPrefix(string(v), "jump "); ok {
+		return &expr.Verdict{Kind: expr.VerdictJump, Chain: chain}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported verdict %q", v)
+}
@@ -0,0 +1,428 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path"
+	"testing"
+	"text/template"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/metal-stack/metal-networker/pkg/net"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCompileNftRuleset_Testdata(t *testing.T) {
+	tests := []struct {
+		input          string
+		enableDNSProxy bool
+	}{
+		{input: "testdata/firewall.yaml"},
+		{input: "testdata/firewall_dmz.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_dmz_app.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_ipv6.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_shared.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_dualstack.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_dns_proxy.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_management_access.yaml"},
+		{input: "testdata/firewall_port_forward.yaml"},
+		{input: "testdata/firewall_static_snat.yaml"},
+		{input: "testdata/firewall_flow_offload.yaml"},
+		{input: "testdata/firewall_conntrack.yaml", enableDNSProxy: true},
+		{input: "testdata/firewall_underlay_ipv6.yaml"},
+		{input: "testdata/firewall_vpn.yaml"},
+		{input: "testdata/firewall_with_rules.yaml"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.input, func(t *testing.T) {
+			kb, err := New(slog.Default(), tt.input)
+			require.NoError(t, err)
+
+			ruleset, err := newNftablesRuleset(*kb, tt.enableDNSProxy, ForwardPolicyDrop)
+			require.NoError(t, err)
+			tables, err := compileNftRuleset(ruleset)
+			require.NoError(t, err)
+			require.Len(t, tables, len(ruleset.Tables))
+
+			for i, table := range tables {
+				require.Len(t, table.flowtables, len(ruleset.Tables[i].Flowtables))
+				require.Len(t, table.chains, len(ruleset.Tables[i].Chains))
+				for j, chain := range table.chains {
+					assert.Len(t, chain.rules, len(ruleset.Tables[i].Chains[j].Rules), chain.chain.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileNftMatch(t *testing.T) {
+	c := &nftCompiler{
+		table: &nftables.Table{Family: nftables.TableFamilyINet, Name: "test"},
+		sets:  map[string]*nftables.Set{"named": {ID: 42, Name: "named"}},
+	}
+
+	tests := []struct {
+		name     string
+		match    NftMatch
+		expected []expr.Any
+		sets     int
+		wantErr  string
+	}{
+		{
+			name:  "wildcard interface",
+			match: nftIfname("iifname", "tailscale*"),
+			expected: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("tailscale")},
+			},
+		},
+		{
+			name:  "prefix",
+			match: nftNotMatch("ip saddr", "10.0.0.0/8"),
+			expected: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{10, 0, 0, 0}},
+			},
+		},
+		{
+			name:  "service name",
+			match: nftMatch("tcp dport", "bgp"),
+			expected: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 179}},
+			},
+		},
+		{
+			name:  "port range",
+			match: nftMatch("udp dport", "1000-2000"),
+			expected: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{0x03, 0xe8}, ToData: []byte{0x07, 0xd0}},
+			},
+		},
+		{
+			name:  "icmp type",
+			match: nftMatch("icmpv6 type", "echo-request"),
+			expected: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{128}},
+			},
+		},
+		{
+			// the names of ICMP types contain dashes but are no ranges
+			name:  "icmp types",
+			match: nftMatch("icmp type", "echo-request", "destination-unreachable"),
+			sets:  1,
+		},
+		{
+			name:  "named set",
+			match: nftMatch("ip daddr", "@named"),
+			expected: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Lookup{SourceRegister: 1, SetName: "named", SetID: 42},
+			},
+		},
+		{
+			name:  "anonymous set",
+			match: nftIfname("oifname", "vrf1", "vlan1"),
+			sets:  1,
+		},
+		{
+			name:    "undefined set",
+			match:   nftMatch("ip daddr", "@undefined"),
+			wantErr: `set "undefined" is not defined`,
+		},
+		{
+			name:    "address of other family",
+			match:   nftMatch("ip6 daddr", "10.0.0.1"),
+			wantErr: "10.0.0.1 is not of type ipv6_addr",
+		},
+		{
+			name:    "unsupported match",
+			match:   nftMatch("ether saddr", "00:00:00:00:00:01"),
+			wantErr: `unsupported match "ether saddr"`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			exprs, sets, err := c.compileMatch(tt.match)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tt.expected != nil {
+				assert.Equal(t, tt.expected, exprs)
+			}
+			assert.Len(t, sets, tt.sets)
+		})
+	}
+}
+
+func TestNftSetElements(t *testing.T) {
+	elements, err := nftSetElements(nftables.TypeIPAddr, true, []string{"192.168.0.0/16", "10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8"})
+	require.NoError(t, err)
+
+	// overlapping and adjacent intervals are merged
+	expected := []nftables.SetElement{
+		{Key: []byte{10, 0, 0, 0}},
+		{Key: []byte{12, 0, 0, 0}, IntervalEnd: true},
+		{Key: []byte{192, 168, 0, 0}},
+		{Key: []byte{192, 169, 0, 0}, IntervalEnd: true},
+	}
+	assert.Equal(t, expected, elements)
+
+	elements, err = nftSetElements(nftables.TypeIPAddr, true, []string{"10.0.0.0/8", "0.0.0.0/0"})
+	require.NoError(t, err)
+
+	// the interval reaching the last address has no end
+	assert.Equal(t, []nftables.SetElement{{Key: []byte{0, 0, 0, 0}}}, elements)
+
+	_, err = nftSetElements(nftables.TypeIPAddr, false, []string{"10.0.0.0/8"})
+	require.EqualError(t, err, `"10.0.0.0/8" requires a set with interval flag`)
+}
+
+func TestNftVerdictMapElements(t *testing.T) {
+	elements, err := nftVerdictMapElements(nftables.TypeInetService, false, "verdict", []string{"22 : jump ingress_tcp_22", "443 : accept"})
+	require.NoError(t, err)
+
+	expected := []nftables.SetElement{
+		{Key: []byte{0, 22}, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "ingress_tcp_22"}},
+		{Key: []byte{1, 187}, VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+	}
+	assert.Equal(t, expected, elements)
+
+	_, err = nftVerdictMapElements(nftables.TypeInetService, false, "verdict", []string{"22"})
+	require.EqualError(t, err, `invalid map element "22"`)
+
+	_, err = nftVerdictMapElements(nftables.TypeInetService, false, "verdict", []string{"80-90 : accept"})
+	require.EqualError(t, err, `"80-90" requires a map with interval flag`)
+
+	elements, err = nftVerdictMapElements(nftables.TypeInetService, true, "verdict",
+		[]string{"100-199 : jump a", "80 : accept", "81-99 : drop"})
+	require.NoError(t, err)
+
+	// the end of an interval is omitted if the next interval starts there
+	expected = []nftables.SetElement{
+		{Key: []byte{0, 80}, VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+		{Key: []byte{0, 81}, VerdictData: &expr.Verdict{Kind: expr.VerdictDrop}},
+		{Key: []byte{0, 100}, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "a"}},
+		{Key: []byte{0, 200}, IntervalEnd: true},
+	}
+	assert.Equal(t, expected, elements)
+
+	_, err = nftVerdictMapElements(nftables.TypeInetService, true, "verdict", []string{"80-90 : accept", "85 : drop"})
+	require.ErrorContains(t, err, "map elements must not overlap")
+}
+
+func TestCompileNftStatement_DNAT(t *testing.T) {
+	c := &nftCompiler{}
+
+	exprs, _, err := c.compileStatement(NftDNAT{Family: "ip6", To: "[fd00::1]:8080"})
+	require.NoError(t, err)
+
+	expected := []expr.Any{
+		&expr.Immediate{Register: 1, Data: netip.MustParseAddr("fd00::1").AsSlice()},
+		&expr.Immediate{Register: 2, Data: []byte{0x1f, 0x90}},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV6, RegAddrMin: 1, RegProtoMin: 2, Specified: true},
+	}
+	assert.Equal(t, expected, exprs)
+
+	_, _, err = c.compileStatement(NftDNAT{Family: "ip", To: "[fd00::1]:8080"})
+	require.EqualError(t, err, "dnat address [fd00::1]:8080 does not belong to family ip")
+}
+
+func TestCompileNftStatement_SNAT(t *testing.T) {
+	c := &nftCompiler{}
+
+	exprs, sets, err := c.compileStatement(NftSNAT{Family: "ip", To: []string{"185.1.2.4"}})
+	require.NoError(t, err)
+	assert.Empty(t, sets)
+	expected := []expr.Any{
+		&expr.Immediate{Register: 1, Data: []byte{185, 1, 2, 4}},
+		&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+	}
+	assert.Equal(t, expected, exprs)
+
+	exprs, sets, err = c.compileStatement(NftSNAT{Family: "ip6", To: []string{"2a02:c00:20::1", "2a02:c00:20::2"}})
+	require.NoError(t, err)
+	require.Len(t, sets, 1)
+	assert.True(t, sets[0].set.IsMap)
+	assert.Equal(t, nftables.TypeIP6Addr, sets[0].set.DataType)
+	require.Len(t, sets[0].elements, 2)
+	assert.Equal(t, netip.MustParseAddr("2a02:c00:20::2").AsSlice(), sets[0].elements[1].Val)
+	assert.Contains(t, exprs, expr.Any(&expr.Hash{SourceRegister: 1, DestRegister: 1, Length: 16, Modulus: 2,
+		Type: expr.HashTypeJenkins}))
+
+	_, _, err = c.compileStatement(NftSNAT{Family: "ip", To: []string{"2a02:c00:20::1"}})
+	require.EqualError(t, err, "snat address 2a02:c00:20::1 does not belong to family ip")
+}
+
+func TestCompileNftFlowtable(t *testing.T) {
+	r := NftRuleset{}
+	tbl := r.Table("inet", "metal")
+	tbl.AddFlowtable(NftFlowtable{Name: "fastpath", Priority: "0", Devices: []string{"lan0", "vlan3981"}, Offload: true})
+	tbl.BaseChain("forward", NftHook{Type: "filter", Hook: "forward", Priority: "0", Policy: "drop"}).
+		Add(NftRule{Statements: []NftStatement{NftFlowOffload{Flowtable: "fastpath"}}})
+
+	tables, err := compileNftRuleset(r)
+	require.NoError(t, err)
+	require.Len(t, tables[0].flowtables, 1)
+
+	f := tables[0].flowtables[0]
+	assert.Equal(t, []string{"lan0", "vlan3981"}, f.Devices)
+	assert.Equal(t, nftables.FlowtableFlagsHWOffload, f.Flags)
+	assert.Equal(t, nftables.FlowtableHookIngress, f.Hooknum)
+	assert.Equal(t, []expr.Any{&expr.FlowOffload{Name: "fastpath"}}, tables[0].chains[0].rules[0].rule.Exprs)
+
+	tbl.Flowtables = nil
+	_, err = compileNftRuleset(r)
+	require.ErrorContains(t, err, `flowtable "fastpath" is not defined`)
+}
+
+func TestNftablesNetlinkValidator_Validate(t *testing.T) {
+	dir := t.TempDir()
+	rules := path.Join(dir, "rules")
+	require.NoError(t, os.WriteFile(rules, []byte("table inet metal {}\n"), 0o600))
+
+	r := NftRuleset{}
+	r.Table("inet", "metal")
+	v := NftablesNetlinkValidator{ruleset: r, path: rules, log: slog.Default()}
+
+	// without nft only the translation into netlink messages is validated
+	t.Setenv("PATH", dir)
+	require.NoError(t, v.Validate())
+
+	// nft --check rejects rules the kernel does not accept
+	nft := "#!/bin/sh\necho \"Error: conflicting intervals specified\" >&2\nexit 1\n"
+	require.NoError(t, os.WriteFile(path.Join(dir, "nft"), []byte(nft), 0o700))
+	require.Error(t, v.Validate())
+}
+
+func TestNftablesNetlinkReloader_Reload(t *testing.T) {
+	r := NftRuleset{}
+	tbl := r.Table("inet", "metal")
+	tbl.BaseChain("input", NftHook{Type: "filter", Hook: "input", Priority: "0", Policy: "accept"}).
+		Add(NftRule{Statements: []NftStatement{NftCounter{}}, Verdict: NftAccept})
+
+	var (
+		batch   []netlink.Message
+		deleted []string
+	)
+	reloader := NftablesNetlinkReloader{
+		ruleset: r,
+		log:     slog.Default(),
+		conn:    fakeNftConn(t, &batch, &deleted),
+	}
+
+	err := reloader.Reload()
+	require.ErrorContains(t, err, "chain input of table metal was not loaded")
+	assert.NotEmpty(t, batch)
+	// only the table of the ruleset is replaced, the ruleset is not flushed
+	assert.Equal(t, []string{"metal"}, deleted)
+}
+
+func TestNftablesNetlinkReloader_Rollback(t *testing.T) {
+	dir := t.TempDir()
+	rules := path.Join(dir, "rules")
+	old := "table inet metal {\n}\n# old\n"
+	require.NoError(t, os.WriteFile(rules, []byte(old), 0o600))
+
+	// nft records the batch it is asked to load
+	loaded := path.Join(dir, "loaded")
+	nft := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %[1]s\ncat \"$2\" >> %[1]s\n", loaded)
+	require.NoError(t, os.WriteFile(path.Join(dir, "nft"), []byte(nft), 0o700))
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	r := NftRuleset{}
+	r.Table("inet", "metal")
+	var (
+		batch   []netlink.Message
+		deleted []string
+	)
+	reloader := NftablesNetlinkReloader{ruleset: r, path: rules, log: slog.Default(), conn: fakeNftConn(t, &batch, &deleted)}
+	noop := NftablesNetlinkValidator{ruleset: r, log: slog.Default()}
+	failing := net.NewNetworkApplier(nil, noop, failingReloader{})
+
+	tx := net.NewTransaction(dir)
+	src, err := tx.TmpFile("nftrules_")
+	require.NoError(t, err)
+	tpl := template.Must(template.New("nftrules").Parse("{{ .Ruleset }}# new\n"))
+	require.NoError(t, tx.Stage(net.NewNetworkApplier(NftablesData{Ruleset: r}, noop, reloader), *tpl, src, rules, fileModeDefault, true))
+	src, err = tx.TmpFile("other_")
+	require.NoError(t, err)
+	tpl = template.Must(template.New("other").Parse("other\n"))
+	require.NoError(t, tx.Stage(failing, *tpl, src, path.Join(dir, "other"), fileModeDefault, true))
+
+	err = tx.Commit()
+	require.ErrorContains(t, err, "failed")
+
+	content, err := os.ReadFile(rules)
+	require.NoError(t, err)
+	assert.Equal(t, old, string(content))
+
+	// the netlink backend only replaced the table with the new ruleset, the rejected ruleset is not loaded again
+	assert.Equal(t, []string{"metal"}, deleted)
+
+	// the restored rules file is loaded by nft instead
+	content, err = os.ReadFile(loaded)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "add table inet metal\ndelete table inet metal\n")
+	assert.Contains(t, string(content), fmt.Sprintf("include %q\n", rules))
+}
+
+type failingReloader struct{}
+
+func (failingReloader) Reload() error {
+	return errors.New("failed")
+}
+
+// fakeNftConn returns a netlink connection that records the messages of every batch in batch and the names of the
+// deleted tables in deleted. Nothing is read back.
+func fakeNftConn(t *testing.T, batch *[]netlink.Message, deleted *[]string) func() (*nftables.Conn, error) {
+	return func() (*nftables.Conn, error) {
+		return nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+			for _, msg := range req {
+				if msg.Header.Flags&netlink.Dump != 0 {
+					return nil, nil
+				}
+				*batch = append(*batch, msg)
+				if msg.Header.Type == netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_DELTABLE) {
+					// a deletion without name flushes the whole ruleset
+					name := ""
+					ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+					require.NoError(t, err)
+					for ad.Next() {
+						if ad.Type() == unix.NFTA_TABLE_NAME {
+							name = ad.String()
+						}
+					}
+					*deleted = append(*deleted, name)
+				}
+			}
+			return req, nil
+		}))
+	}
+}
@@ -0,0 +1,428 @@
+package netconf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// nftIndent is the indentation of a single level of the rendered ruleset.
+const nftIndent = "    "
+
+type (
+	// NftRuleset is a typed representation of an nftables ruleset. It renders to nft syntax deterministically,
+	// every element is rendered in the order it was added.
+	NftRuleset struct {
+		Tables []*NftTable
+	}
+
+	// NftTable is a table of a ruleset.
+	NftTable struct {
+		Family     string
+		Name       string
+		Sets       []*NftSet
+		Flowtables []*NftFlowtable
+		Chains     []*NftChain
+	}
+
+	// NftSet is a named set of a table. A set with a data type is a map, its elements are given as "key : value".
+	NftSet struct {
+		Name      string
+		Type      string
+		DataType  string
+		Flags     []string
+		AutoMerge bool
+		Elements  []string
+	}
+
+	// NftFlowtable is a flowtable of a table. Connections added to it bypass the rules of the forward chain and are
+	// forwarded on the fast path between the given devices.
+	NftFlowtable struct {
+		Name     string
+		Priority string
+		Devices  []string
+		// Offload offloads the flows to the hardware of the devices.
+		Offload bool
+	}
+
+	// NftChain is a chain of a table. Base chains are attached to a hook, regular chains are only reachable by jumps.
+	NftChain struct {
+		Name  string
+		Hook  *NftHook
+		Rules []NftRule
+	}
+
+	// NftHook attaches a base chain to a netfilter hook.
+	NftHook struct {
+		Type     string
+		Hook     string
+		Priority string
+		Policy   string
+	}
+
+	// NftRule is a single rule of a chain. A packet matching all matches is processed by the statements in order and
+	// the verdict is applied at last.
+	NftRule struct {
+		Matches    []NftMatch
+		Statements []NftStatement
+		Verdict    NftVerdict
+		Comment    string
+	}
+
+	// NftMatch compares a packet property like "ip saddr" with a single value or a set of values.
+	NftMatch struct {
+		Left   string
+		Op     string
+		Values []string
+	}
+
+	// NftStatement is an action of a rule that is not a verdict.
+	NftStatement interface {
+		nft() string
+	}
+
+	// NftVerdict decides the fate of a packet, it is empty for rules that only apply statements.
+	NftVerdict string
+
+	// NftCounter counts packets and bytes.
+	NftCounter struct{}
+
+	// NftLimit limits the rate of packets processed by the following statements.
+	NftLimit struct {
+		Rate string
+	}
+
+	// NftCTCount matches as long as the number of connections counted by the rule does not exceed the count.
+	NftCTCount struct {
+		Count uint32
+	}
+
+	// NftLog logs packets with the given prefix.
+	NftLog struct {
+		Prefix string
+	}
+
+	// NftCTZone assigns packets to a conntrack zone.
+	NftCTZone struct {
+		Zone string
+	}
+
+	// NftMasquerade rewrites the source address to the address of the outgoing interface.
+	NftMasquerade struct {
+		Random bool
+	}
+
+	// NftVerdictMap looks up the verdict for the given left hand side like "tcp dport" in a map.
+	NftVerdictMap struct {
+		Left string
+		Map  string
+	}
+
+	// NftSNAT rewrites the source address to the given address. Several addresses are used as pool, the source address
+	// is hashed onto them so that a source always gets the same address.
+	NftSNAT struct {
+		Family string
+		To     []string
+	}
+
+	// NftFlowOffload adds the connection of the packet to the given flowtable.
+	NftFlowOffload struct {
+		Flowtable string
+	}
+
+	// NftDNAT rewrites the destination address.
+	NftDNAT struct {
+		Family string
+		To     string
+	}
+)
+
+const (
+	// NftAccept accepts the packet.
+	NftAccept = NftVerdict("accept")
+	// NftDrop drops the packet.
+	NftDrop = NftVerdict("drop")
+)
+
+// NftJump continues processing in the given chain.
+func NftJump(chain string) NftVerdict {
+	return NftVerdict("jump " + chain)
+}
+
+// nftMatch returns a match of the given left hand side with one or a set of values.
+func nftMatch(left string, values ...string) NftMatch {
+	return NftMatch{Left: left, Values: values}
+}
+
+// nftNotMatch returns a match of the given left hand side with none of the given values.
+func nftNotMatch(left string, values ...string) NftMatch {
+	return NftMatch{Left: left, Op: "!=", Values: values}
+}
+
+// nftIfname returns a match of an interface name, left is either iifname or oifname.
+func nftIfname(left string, names ...string) NftMatch {
+	quoted := make([]string, 0, len(names))
+	for _, n := range names {
+		quoted = append(quoted, nftString(n))
+	}
+
+	return nftMatch(left, quoted...)
+}
+
+// nftString quotes the given string for nft. nft does not support escape sequences, double quotes and line breaks are
+// replaced therefore.
+func nftString(s string) string {
+	s = strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(s)
+	return `"` + s + `"`
+}
+
+// Table returns the table with the given family and name, it is added to the ruleset if it does not exist.
+func (r *NftRuleset) Table(family, name string) *NftTable {
+	for _, t := range r.Tables {
+		if t.Family == family && t.Name == name {
+			return t
+		}
+	}
+
+	t := &NftTable{Family: family, Name: name}
+	r.Tables = append(r.Tables, t)
+
+	return t
+}
+
+// Chain returns the chain with the given name, it is added to the table if it does not exist.
+func (t *NftTable) Chain(name string) *NftChain {
+	for _, c := range t.Chains {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	c := &NftChain{Name: name}
+	t.Chains = append(t.Chains, c)
+
+	return c
+}
+
+// BaseChain returns the chain with the given name attached to the given hook, it is added to the table if it does
+// not exist.
+func (t *NftTable) BaseChain(name string, hook NftHook) *NftChain {
+	c := t.Chain(name)
+	c.Hook = &hook
+
+	return c
+}
+
+// AddSet adds the given set to the table, a set with the same name is replaced.
+func (t *NftTable) AddSet(s NftSet) {
+	for i, existing := range t.Sets {
+		if existing.Name == s.Name {
+			t.Sets[i] = &s
+			return
+		}
+	}
+
+	t.Sets = append(t.Sets, &s)
+}
+
+// AddFlowtable adds the given flowtable to the table, a flowtable with the same name is replaced.
+func (t *NftTable) AddFlowtable(f NftFlowtable) {
+	for i, existing := range t.Flowtables {
+		if existing.Name == f.Name {
+			t.Flowtables[i] = &f
+			return
+		}
+	}
+
+	t.Flowtables = append(t.Flowtables, &f)
+}
+
+// Add appends the given rules to the chain. Rules equal to a rule already contained are skipped.
+func (c *NftChain) Add(rules ...NftRule) {
+	for _, r := range rules {
+		if slices.ContainsFunc(c.Rules, r.equal) {
+			continue
+		}
+		c.Rules = append(c.Rules, r)
+	}
+}
+
+// String renders the ruleset in nft syntax.
+func (r NftRuleset) String() string {
+	var b strings.Builder
+
+	for _, t := range r.Tables {
+		t.render(&b)
+	}
+
+	return b.String()
+}
+
+func (t *NftTable) render(b *strings.Builder) {
+	fmt.Fprintf(b, "table %s %s {\n", t.Family, t.Name)
+
+	for _, s := range t.Sets {
+		s.render(b)
+	}
+
+	for _, f := range t.Flowtables {
+		f.render(b)
+	}
+
+	for _, c := range t.Chains {
+		c.render(b)
+	}
+
+	b.WriteString("}\n")
+}
+
+func (s *NftSet) render(b *strings.Builder) {
+	if s.DataType != "" {
+		fmt.Fprintf(b, "%smap %s {\n", nftIndent, s.Name)
+		fmt.Fprintf(b, "%stype %s : %s\n", nftIndent+nftIndent, s.Type, s.DataType)
+	} else {
+		fmt.Fprintf(b, "%sset %s {\n", nftIndent, s.Name)
+		fmt.Fprintf(b, "%stype %s\n", nftIndent+nftIndent, s.Type)
+	}
+
+	if len(s.Flags) > 0 {
+		fmt.Fprintf(b, "%sflags %s\n", nftIndent+nftIndent, strings.Join(s.Flags, ", "))
+	}
+
+	if s.AutoMerge {
+		fmt.Fprintf(b, "%sauto-merge\n", nftIndent+nftIndent)
+	}
+
+	if len(s.Elements) > 0 {
+		fmt.Fprintf(b, "%selements = { %s }\n", nftIndent+nftIndent, strings.Join(s.Elements, ", "))
+	}
+
+	fmt.Fprintf(b, "%s}\n", nftIndent)
+}
+
+func (f *NftFlowtable) render(b *strings.Builder) {
+	fmt.Fprintf(b, "%sflowtable %s {\n", nftIndent, f.Name)
+	fmt.Fprintf(b, "%shook ingress priority %s\n", nftIndent+nftIndent, f.Priority)
+	fmt.Fprintf(b, "%sdevices = { %s }\n", nftIndent+nftIndent, strings.Join(f.Devices, ", "))
+
+	if f.Offload {
+		fmt.Fprintf(b, "%sflags offload\n", nftIndent+nftIndent)
+	}
+
+	fmt.Fprintf(b, "%s}\n", nftIndent)
+}
+
+func (c *NftChain) render(b *strings.Builder) {
+	fmt.Fprintf(b, "%schain %s {\n", nftIndent, c.Name)
+
+	if c.Hook != nil {
+		fmt.Fprintf(b, "%stype %s hook %s priority %s; policy %s;\n", nftIndent+nftIndent, c.Hook.Type, c.Hook.Hook,
+			c.Hook.Priority, c.Hook.Policy)
+	}
+
+	for _, r := range c.Rules {
+		fmt.Fprintf(b, "%s%s\n", nftIndent+nftIndent, r)
+	}
+
+	fmt.Fprintf(b, "%s}\n", nftIndent)
+}
+
+// String renders the rule in nft syntax.
+func (r NftRule) String() string {
+	var parts []string
+
+	for _, m := range r.Matches {
+		parts = append(parts, m.String())
+	}
+
+	for _, s := range r.Statements {
+		parts = append(parts, s.nft())
+	}
+
+	if r.Verdict != "" {
+		parts = append(parts, string(r.Verdict))
+	}
+
+	if r.Comment != "" {
+		parts = append(parts, "comment "+nftString(r.Comment))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (r NftRule) equal(other NftRule) bool {
+	return r.String() == other.String()
+}
+
+// String renders the match in nft syntax, several values are rendered as anonymous set.
+func (m NftMatch) String() string {
+	parts := []string{m.Left}
+
+	if m.Op != "" {
+		parts = append(parts, m.Op)
+	}
+
+	switch len(m.Values) {
+	case 0:
+	case 1:
+		parts = append(parts, m.Values[0])
+	default:
+		parts = append(parts, "{ "+strings.Join(m.Values, ", ")+" }")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (NftCounter) nft() string {
+	return "counter"
+}
+
+func (l NftLimit) nft() string {
+	return "limit rate " + l.Rate
+}
+
+func (c NftCTCount) nft() string {
+	return fmt.Sprintf("ct count %d", c.Count)
+}
+
+func (l NftLog) nft() string {
+	return "log prefix " + nftString(l.Prefix)
+}
+
+func (z NftCTZone) nft() string {
+	return "ct zone set " + z.Zone
+}
+
+func (m NftMasquerade) nft() string {
+	if m.Random {
+		return "masquerade random"
+	}
+
+	return "masquerade"
+}
+
+func (m NftVerdictMap) nft() string {
+	return m.Left + " vmap " + m.Map
+}
+
+func (s NftSNAT) nft() string {
+	if len(s.To) == 1 {
+		return fmt.Sprintf("snat %s to %s", s.Family, s.To[0])
+	}
+
+	elements := make([]string, 0, len(s.To))
+	for i, to := range s.To {
+		elements = append(elements, fmt.Sprintf("%d : %s", i, to))
+	}
+
+	return fmt.Sprintf("snat %s to jhash %s saddr mod %d map { %s }", s.Family, s.Family, len(s.To),
+		strings.Join(elements, ", "))
+}
+
+func (f NftFlowOffload) nft() string {
+	return "flow add @" + f.Flowtable
+}
+
+func (d NftDNAT) nft() string {
+	return fmt.Sprintf("dnat %s to %s", d.Family, d.To)
+}
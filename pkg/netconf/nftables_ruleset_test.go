@@ -0,0 +1,91 @@
+package netconf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNftRule_String(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     NftRule
+		expected string
+	}{
+		{
+			name:     "statements only",
+			rule:     NftRule{Statements: []NftStatement{NftCounter{}, NftMasquerade{Random: true}}},
+			expected: "counter masquerade random",
+		},
+		{
+			name: "single and multiple values",
+			rule: NftRule{
+				Matches:    []NftMatch{nftIfname("iifname", "vrf1", "vrf2"), nftMatch("tcp dport", "443")},
+				Statements: []NftStatement{NftCounter{}},
+				Verdict:    NftAccept,
+			},
+			expected: `iifname { "vrf1", "vrf2" } tcp dport 443 counter accept`,
+		},
+		{
+			name: "negated match and jump",
+			rule: NftRule{
+				Matches: []NftMatch{nftNotMatch("ip daddr", "10.0.0.1")},
+				Verdict: NftJump("refuse"),
+			},
+			expected: "ip daddr != 10.0.0.1 jump refuse",
+		},
+		{
+			name: "comment is sanitized",
+			rule: NftRule{
+				Verdict: NftDrop,
+				Comment: "say \"hi\"\nthere",
+			},
+			expected: `drop comment "say 'hi' there"`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.rule.String())
+		})
+	}
+}
+
+func TestNftRuleset_String(t *testing.T) {
+	r := NftRuleset{}
+	tbl := r.Table("inet", "test")
+	tbl.AddSet(NftSet{Name: "s", Type: "ipv4_addr", Elements: []string{"1.1.1.1"}})
+	tbl.AddSet(NftSet{Name: "s", Type: "ipv4_addr", Flags: []string{"interval"}, AutoMerge: true, Elements: []string{"1.0.0.0/8"}})
+	tbl.AddFlowtable(NftFlowtable{Name: "f", Priority: "0", Devices: []string{"lan0", "lan1"}, Offload: true})
+
+	input := tbl.BaseChain("input", NftHook{Type: "filter", Hook: "input", Priority: "0", Policy: "drop"})
+	rule := NftRule{Matches: []NftMatch{nftMatch("ip saddr", "@s")}, Verdict: NftAccept}
+	input.Add(rule, rule)
+
+	tbl.Chain("refuse").Add(NftRule{Verdict: NftDrop})
+	assert.Same(t, tbl, r.Table("inet", "test"))
+
+	expected := `table inet test {
+    set s {
+        type ipv4_addr
+        flags interval
+        auto-merge
+        elements = { 1.0.0.0/8 }
+    }
+    flowtable f {
+        hook ingress priority 0
+        devices = { lan0, lan1 }
+        flags offload
+    }
+    chain input {
+        type filter hook input priority 0; policy drop;
+        ip saddr @s accept
+    }
+    chain refuse {
+        drop
+    }
+}
+`
+	assert.Equal(t, expected, r.String())
+}
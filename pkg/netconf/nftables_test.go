@@ -6,6 +6,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/metal-stack/metal-go/api/models"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -54,6 +56,54 @@ func TestCompileNftRules(t *testing.T) {
 			enableDNSProxy: true,
 			forwardPolicy:  ForwardPolicyDrop,
 		},
+		{
+			input:          "testdata/firewall_dualstack.yaml",
+			expected:       "testdata/nftrules_dualstack",
+			enableDNSProxy: true,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_dns_proxy.yaml",
+			expected:       "testdata/nftrules_dns_proxy",
+			enableDNSProxy: true,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_management_access.yaml",
+			expected:       "testdata/nftrules_management_access",
+			enableDNSProxy: false,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_port_forward.yaml",
+			expected:       "testdata/nftrules_port_forward",
+			enableDNSProxy: false,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_static_snat.yaml",
+			expected:       "testdata/nftrules_static_snat",
+			enableDNSProxy: false,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_flow_offload.yaml",
+			expected:       "testdata/nftrules_flow_offload",
+			enableDNSProxy: false,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_conntrack.yaml",
+			expected:       "testdata/nftrules_conntrack",
+			enableDNSProxy: true,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
+		{
+			input:          "testdata/firewall_underlay_ipv6.yaml",
+			expected:       "testdata/nftrules_underlay_ipv6",
+			enableDNSProxy: false,
+			forwardPolicy:  ForwardPolicyDrop,
+		},
 		{
 			input:          "testdata/firewall_vpn.yaml",
 			expected:       "testdata/nftrules_vpn",
@@ -78,7 +128,8 @@ func TestCompileNftRules(t *testing.T) {
 			kb, err := New(log, tt.input)
 			require.NoError(t, err)
 
-			a := newNftablesConfigApplier(*kb, nil, tt.enableDNSProxy, tt.forwardPolicy)
+			a, err := newNftablesConfigApplier(*kb, nil, tt.enableDNSProxy, tt.forwardPolicy)
+			require.NoError(t, err)
 			b := bytes.Buffer{}
 
 			tpl := MustParseTpl(TplNftables)
@@ -88,3 +139,286 @@ func TestCompileNftRules(t *testing.T) {
 		})
 	}
 }
+
+func TestAddFirewallRules(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	kb.FirewallRules = &models.V1FirewallRules{
+		Egress: []*models.V1FirewallEgressRule{
+			{Protocol: "TCP", Ports: []int32{443, 80}, To: []string{"1.1.1.0/24", "2.2.2.0/24"}, Comment: "web"},
+			{Protocol: "tcp", Ports: []int32{80, 443}, To: []string{"3.3.3.0/24", "1.1.1.0/24"}, Comment: "more web"},
+			{Protocol: "tcp", Ports: []int32{443}, To: []string{"4.4.4.0/24"}, Comment: "https only"},
+			{Protocol: "udp", Ports: []int32{53}, To: []string{"5.5.5.5/32"}},
+		},
+	}
+
+	r := NftRuleset{}
+	table := r.Table("inet", "metal")
+	forward := table.Chain("forward")
+	require.NoError(t, addFirewallRules(table, forward, *kb))
+
+	// every port is dispatched by the verdict map into its own chain, rules with different comments do not share a set
+	assert.Equal(t, []string{
+		`iifname { "vrf3981", "vrf3982" } tcp dport vmap @egress_tcp`,
+		`iifname { "vrf3981", "vrf3982" } udp dport vmap @egress_udp`,
+	}, ruleStrings(forward))
+
+	assert.Equal(t, []string{"1.1.1.0/24", "2.2.2.0/24"}, findSet(t, table, "egress_tcp_addresses_0").Elements)
+	assert.Equal(t, []string{"3.3.3.0/24", "1.1.1.0/24"}, findSet(t, table, "egress_tcp_addresses_1").Elements)
+	assert.Equal(t, []string{"4.4.4.0/24"}, findSet(t, table, "egress_tcp_addresses_2").Elements)
+	assert.Equal(t, []string{"80 : jump egress_tcp_80", "443 : jump egress_tcp_443"}, findSet(t, table, "egress_tcp").Elements)
+
+	assert.Equal(t, []string{
+		`ip daddr @egress_tcp_addresses_0 counter accept comment "web"`,
+		`ip daddr @egress_tcp_addresses_1 counter accept comment "more web"`,
+	}, ruleStrings(table.Chain("egress_tcp_80")))
+	assert.Equal(t, []string{
+		`ip daddr @egress_tcp_addresses_0 counter accept comment "web"`,
+		`ip daddr @egress_tcp_addresses_1 counter accept comment "more web"`,
+		`ip daddr @egress_tcp_addresses_2 counter accept comment "https only"`,
+	}, ruleStrings(table.Chain("egress_tcp_443")))
+	assert.Equal(t, []string{
+		`ip daddr @egress_udp_addresses_0 counter accept`,
+	}, ruleStrings(table.Chain("egress_udp_53")))
+
+	_, err = compileNftRuleset(r)
+	require.NoError(t, err)
+}
+
+func TestAddFirewallRules_Protocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		egress  []firewallRule
+		ingress []firewallRule
+		forward []string
+		chains  map[string][]string
+		maps    map[string][]string
+	}{
+		{
+			name: "tcp port ranges",
+			egress: []firewallRule{
+				{Protocol: "tcp", Ports: []string{"80", "1000-2000"}, To: []string{"1.1.1.0/24"}, Comment: "range"},
+				{Protocol: "tcp", Ports: []string{"1500"}, To: []string{"2.2.2.0/24"}},
+			},
+			forward: []string{`iifname { "vrf3981", "vrf3982" } tcp dport vmap @egress_tcp`},
+			chains: map[string][]string{
+				"egress_tcp_80":        {`ip daddr @egress_tcp_addresses_0 counter accept comment "range"`},
+				"egress_tcp_1000_1499": {`ip daddr @egress_tcp_addresses_0 counter accept comment "range"`},
+				"egress_tcp_1500": {
+					`ip daddr @egress_tcp_addresses_0 counter accept comment "range"`,
+					`ip daddr @egress_tcp_addresses_1 counter accept`,
+				},
+				"egress_tcp_1501_2000": {`ip daddr @egress_tcp_addresses_0 counter accept comment "range"`},
+			},
+			maps: map[string][]string{
+				"egress_tcp": {
+					"80 : jump egress_tcp_80",
+					"1000-1499 : jump egress_tcp_1000_1499",
+					"1500 : jump egress_tcp_1500",
+					"1501-2000 : jump egress_tcp_1501_2000",
+				},
+			},
+		},
+		{
+			name:    "udp without ports",
+			ingress: []firewallRule{{Protocol: "udp", From: []string{"fd00::/8"}, To: []string{"2001:db8::/64"}}},
+			forward: []string{`meta l4proto udp jump ingress_udp_any`},
+			chains: map[string][]string{
+				"ingress_udp_any": {`ip6 daddr 2001:db8::/64 ip6 saddr @ingress_udp_addresses_0 counter accept`},
+			},
+		},
+		{
+			name: "icmp types",
+			ingress: []firewallRule{
+				{Protocol: "icmp", ICMPTypes: []string{"echo-request", "echo-reply"}, From: []string{"10.0.0.0/8"}},
+				{Protocol: "icmp", From: []string{"192.168.0.0/16"}},
+			},
+			forward: []string{`meta l4proto icmp jump ingress_icmp`},
+			chains: map[string][]string{
+				"ingress_icmp": {
+					`oifname { "vrf3981", "vni3981", "vlan3981" } icmp type { echo-reply, echo-request } ip saddr @ingress_icmp_addresses_0 counter accept`,
+					`oifname { "vrf3981", "vni3981", "vlan3981" } ip saddr @ingress_icmp_addresses_1 counter accept`,
+				},
+			},
+		},
+		{
+			name:    "icmpv6 types",
+			egress:  []firewallRule{{Protocol: "icmpv6", ICMPTypes: []string{"echo-request"}, To: []string{"::/0"}}},
+			forward: []string{`iifname { "vrf3981", "vrf3982" } meta l4proto ipv6-icmp jump egress_icmpv6`},
+			chains: map[string][]string{
+				"egress_icmpv6": {`icmpv6 type echo-request ip6 daddr @egress_icmpv6_addresses_0 counter accept`},
+			},
+		},
+		{
+			name: "logging and limits",
+			egress: []firewallRule{
+				{Protocol: "tcp", Ports: []string{"443"}, To: []string{"1.1.1.0/24"}},
+				{Protocol: "tcp", Ports: []string{"443"}, To: []string{"2.2.2.0/24"}, Log: true, Comment: "logged"},
+				{Protocol: "tcp", Ports: []string{"443"}, To: []string{"3.3.3.0/24"}, Log: true, LogPrefix: "siem-web: ",
+					Limit: "100/second", ConnectionLimit: 50},
+			},
+			forward: []string{
+				`iifname { "vrf3981", "vrf3982" } meta l4proto tcp tcp dport 443 ip daddr @egress_limit_0_ip_addresses jump egress_limit_0`,
+				`iifname { "vrf3981", "vrf3982" } tcp dport vmap @egress_tcp`,
+			},
+			chains: map[string][]string{
+				// rules with different options do not share a set
+				"egress_tcp_443": {
+					`ip daddr @egress_tcp_addresses_0 counter accept`,
+					`ip daddr @egress_tcp_addresses_1 counter log prefix "nftables-metal-egress-1: " accept comment "logged"`,
+				},
+				"egress_limit_0": {`limit rate 100/second ct count 50 counter log prefix "siem-web: " accept`},
+			},
+		},
+		{
+			name: "limit shared by all ports and address families",
+			egress: []firewallRule{
+				{Protocol: "tcp", Ports: []string{"443", "80", "8000-8100", "8080"}, To: []string{"1.1.1.0/24", "2001:db8::/64"},
+					Limit: "10/second", Comment: "limited web"},
+			},
+			forward: []string{
+				`iifname { "vrf3981", "vrf3982" } meta l4proto tcp tcp dport { 80, 443, 8000-8100 } ip daddr @egress_limit_0_ip_addresses jump egress_limit_0`,
+				`iifname { "vrf3981", "vrf3982" } meta l4proto tcp tcp dport { 80, 443, 8000-8100 } ip6 daddr @egress_limit_0_ip6_addresses jump egress_limit_0`,
+			},
+			chains: map[string][]string{
+				"egress_limit_0": {`limit rate 10/second counter accept comment "limited web"`},
+			},
+		},
+		{
+			name: "limited rules sharing ports",
+			ingress: []firewallRule{
+				{Protocol: "udp", Ports: []string{"53"}, From: []string{"10.0.0.0/8"}, ConnectionLimit: 100, Comment: "dns a"},
+				{Protocol: "udp", Ports: []string{"53"}, From: []string{"10.0.0.0/8"}, ConnectionLimit: 100, Comment: "dns a"},
+				{Protocol: "icmp", ICMPTypes: []string{"echo-request"}, From: []string{"10.0.0.0/8"}, Limit: "5/second"},
+			},
+			// every rule gets its own limit even if the rules are equal
+			forward: []string{
+				`meta l4proto udp udp dport 53 oifname { "vrf3981", "vni3981", "vlan3981" } ip saddr @ingress_limit_0_ip_addresses jump ingress_limit_0`,
+				`meta l4proto udp udp dport 53 oifname { "vrf3981", "vni3981", "vlan3981" } ip saddr @ingress_limit_1_ip_addresses jump ingress_limit_1`,
+				`meta l4proto icmp icmp type echo-request oifname { "vrf3981", "vni3981", "vlan3981" } ip saddr @ingress_limit_2_ip_addresses jump ingress_limit_2`,
+			},
+			chains: map[string][]string{
+				"ingress_limit_0": {`ct count 100 counter accept comment "dns a"`},
+				"ingress_limit_1": {`ct count 100 counter accept comment "dns a"`},
+				"ingress_limit_2": {`limit rate 5/second counter accept`},
+			},
+		},
+		{
+			name:    "any protocol",
+			egress:  []firewallRule{{Protocol: "any", To: []string{"10.1.0.0/16", "fd00:1::/32"}, Comment: "backup"}},
+			forward: []string{`iifname { "vrf3981", "vrf3982" } jump egress_any`},
+			chains: map[string][]string{
+				"egress_any": {
+					`ip daddr @egress_any_addresses_0 counter accept comment "backup"`,
+					`ip6 daddr @egress_any_addresses_1 counter accept comment "backup"`,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			kb, err := New(slog.Default(), "testdata/firewall.yaml")
+			require.NoError(t, err)
+			kb.Networker.FirewallRules = firewallRulesConfig{Egress: tt.egress, Ingress: tt.ingress}
+			require.NoError(t, kb.validateFirewallRules())
+
+			r := NftRuleset{}
+			table := r.Table("inet", "metal")
+			forward := table.Chain("forward")
+			require.NoError(t, addFirewallRules(table, forward, *kb))
+
+			assert.Equal(t, tt.forward, ruleStrings(forward))
+			for name, rules := range tt.chains {
+				assert.Equal(t, rules, ruleStrings(table.Chain(name)), name)
+			}
+			for name, elements := range tt.maps {
+				assert.Equal(t, elements, findSet(t, table, name).Elements, name)
+			}
+
+			_, err = compileNftRuleset(r)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestAddFirewallRules_InvalidPort(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	// the rules are not validated, an invalid port must not widen the rule to all ports
+	kb.Networker.FirewallRules = firewallRulesConfig{
+		Egress: []firewallRule{{Protocol: "tcp", Ports: []string{"http"}, To: []string{"1.1.1.0/24"}}},
+	}
+
+	r := NftRuleset{}
+	table := r.Table("inet", "metal")
+	forward := table.Chain("forward")
+	require.EqualError(t, addFirewallRules(table, forward, *kb), `egress firewall rule 0: invalid port "http"`)
+	assert.Empty(t, ruleStrings(forward))
+
+	_, err = newNftablesConfigApplier(*kb, nil, false, ForwardPolicyDrop)
+	require.Error(t, err)
+}
+
+func TestAddFirewallRules_WithoutPorts(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	// rules of metal-api list their ports explicitly, a rule without ports must not allow all ports
+	kb.FirewallRules = &models.V1FirewallRules{
+		Ingress: []*models.V1FirewallIngressRule{{Protocol: "udp", From: []string{"10.0.0.0/8"}}},
+	}
+	require.EqualError(t, kb.validateFirewallRules(), "ingress firewall rule 0: no ports given")
+
+	r := NftRuleset{}
+	table := r.Table("inet", "metal")
+	forward := table.Chain("forward")
+	require.EqualError(t, addFirewallRules(table, forward, *kb), "ingress firewall rule 0: no ports given")
+	assert.Empty(t, ruleStrings(forward))
+
+	// rules of the networker section allow all ports if they have none
+	kb.FirewallRules = nil
+	kb.Networker.FirewallRules = firewallRulesConfig{
+		Ingress: []firewallRule{{Protocol: "udp", From: []string{"10.0.0.0/8"}}},
+	}
+	require.NoError(t, kb.validateFirewallRules())
+
+	r = NftRuleset{}
+	table = r.Table("inet", "metal")
+	forward = table.Chain("forward")
+	require.NoError(t, addFirewallRules(table, forward, *kb))
+	assert.Equal(t, []string{`meta l4proto udp jump ingress_udp_any`}, ruleStrings(forward))
+}
+
+func ruleStrings(c *NftChain) []string {
+	var result []string
+	for _, r := range c.Rules {
+		result = append(result, r.String())
+	}
+
+	return result
+}
+
+func findSet(t *testing.T, table *NftTable, name string) *NftSet {
+	for _, s := range table.Sets {
+		if s.Name == name {
+			return s
+		}
+	}
+	require.Failf(t, "set not found", "set %s", name)
+
+	return nil
+}
+
+func TestGetUnderlayPrefixes(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall_underlay_ipv6.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fd00:0:0:10::/64", "fd00:0:0:11::/64"}, getUnderlayPrefixes(*kb))
+	assert.Equal(t, []string{"lan0", "lan1", "lan2"}, kb.getLANInterfaces())
+
+	kb.getUnderlayNetwork().Prefixes = nil
+	assert.Equal(t, defaultUnderlayPrefixes, getUnderlayPrefixes(*kb))
+}
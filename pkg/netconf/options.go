@@ -0,0 +1,86 @@
+package netconf
+
+import (
+	"path/filepath"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Option configures optional behavior of a Configurator.
+type Option func(*options)
+
+// options holds the optional settings of a Configurator.
+type options struct {
+	// root is the directory all artifacts are written to.
+	root string
+	// reload defines whether services are reloaded after their artifacts changed.
+	reload bool
+	// metrics records the outcome of every configuration run, it is nil if metrics are disabled.
+	metrics *Metrics
+	// frrVersion is the version of FRR to render frr.conf for, it is detected if nil.
+	frrVersion *semver.Version
+	// versionCmd runs a command and returns its output to detect the version of FRR, exec.NewVerboseCmd is used if nil.
+	versionCmd func(name string, args ...string) (string, error)
+	// nftablesNetlink defines whether nftables rules are loaded via netlink instead of reloading nftables.service.
+	nftablesNetlink bool
+}
+
+// WithRoot lets the configurator write all artifacts below the given root directory instead of "/", e.g. to
+// configure a mounted image from the outside or to render artifacts into a temporary directory.
+// Services of the running system are not reloaded in that case and units are enabled with systemctl --root.
+func WithRoot(root string) Option {
+	return func(o *options) {
+		o.root = root
+	}
+}
+
+// WithServiceReload lets the configurator reload frr, systemd-networkd and the generated systemd units whenever their
+// artifacts changed, which is required to apply changes to a running system without a reboot.
+// nftables is reloaded regardless of this option.
+func WithServiceReload() Option {
+	return func(o *options) {
+		o.reload = true
+	}
+}
+
+// WithFRRVersion lets the configurator render frr.conf for the given version of FRR instead of detecting the installed
+// version, which is required if the artifacts are rendered for another system with WithRoot.
+func WithFRRVersion(v *semver.Version) Option {
+	return func(o *options) {
+		o.frrVersion = v
+	}
+}
+
+// WithNftablesNetlink lets the configurator validate and load the nftables rules via netlink instead of running
+// nft --check and reloading nftables.service. The tables of the metal-networker are replaced in a single atomic batch,
+// tables of other components like the firewall-controller are left untouched.
+// The rules are still written to /etc/nftables/rules to be loaded on boot.
+func WithNftablesNetlink() Option {
+	return func(o *options) {
+		o.nftablesNetlink = true
+	}
+}
+
+func newOptions(opts ...Option) options {
+	o := options{root: "/"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// path returns the location of the given absolute path below the root directory.
+func (o options) path(p string) string {
+	return filepath.Join(o.root, p)
+}
+
+// isHostRoot returns true if artifacts are written to the running system.
+func (o options) isHostRoot() bool {
+	return filepath.Clean(o.root) == "/"
+}
+
+// reloadServices returns true if services of the running system should be reloaded after their artifacts changed.
+func (o options) reloadServices() bool {
+	return o.reload && o.isHostRoot()
+}
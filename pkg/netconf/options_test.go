@@ -0,0 +1,42 @@
+package netconf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantPath   string
+		wantIsHost bool
+	}{
+		{
+			name:       "defaults to the running system",
+			wantPath:   "/etc/frr/frr.conf",
+			wantIsHost: true,
+		},
+		{
+			name:       "explicit root",
+			opts:       []Option{WithRoot("/")},
+			wantPath:   "/etc/frr/frr.conf",
+			wantIsHost: true,
+		},
+		{
+			name:       "chroot",
+			opts:       []Option{WithRoot("/mnt/image/")},
+			wantPath:   "/mnt/image/etc/frr/frr.conf",
+			wantIsHost: false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOptions(tt.opts...)
+			assert.Equal(t, tt.wantPath, o.path("/etc/frr/frr.conf"))
+			assert.Equal(t, tt.wantIsHost, o.isHostRoot())
+		})
+	}
+}
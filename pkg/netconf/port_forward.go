@@ -0,0 +1,201 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/metal-stack/metal-go/api/models"
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+)
+
+// portForward publishes a service of a tenant network at a public IP of an external network.
+type portForward struct {
+	Comment string `yaml:"comment"`
+	// Protocol is either tcp or udp, tcp is used if empty.
+	Protocol string `yaml:"protocol"`
+	// PublicIP is the address the service is published at, it must be an IP of an external network.
+	PublicIP string `yaml:"public_ip"`
+	// Port is the published port or port range.
+	Port string `yaml:"port"`
+	// TargetIP is the address of the service, it must belong to a prefix of a private network.
+	TargetIP string `yaml:"target_ip"`
+	// TargetPort is the port of the service, it defaults to the published port and must not be given for port ranges.
+	TargetPort string `yaml:"target_port"`
+	// From are the source prefixes allowed to reach the service, all sources are allowed if empty.
+	From []string `yaml:"from"`
+}
+
+// validatePortForwards checks that every port forward publishes at an IP of an external network and targets a prefix
+// of a private network of the same address family.
+func (c config) validatePortForwards() error {
+	var errs []error
+	for i, f := range c.Networker.PortForwards {
+		if err := f.validate(c); err != nil {
+			errs = append(errs, fmt.Errorf("port forward %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (f portForward) validate(c config) error {
+	protocol := firewallRule{Protocol: f.Protocol}.protocol()
+	if protocol != protocolTCP && protocol != protocolUDP {
+		return fmt.Errorf("unsupported protocol %q", f.Protocol)
+	}
+
+	port, err := parsePortRange(f.Port)
+	if err != nil {
+		return err
+	}
+	if f.TargetPort != "" {
+		if port.from != port.to {
+			return errors.New("target port must not be given for port ranges")
+		}
+		target, err := parsePortRange(f.TargetPort)
+		if err != nil {
+			return err
+		}
+		if target.from != target.to {
+			return fmt.Errorf("target port %q must be a single port", f.TargetPort)
+		}
+	}
+
+	public, err := netip.ParseAddr(f.PublicIP)
+	if err != nil {
+		return fmt.Errorf("invalid public ip %q", f.PublicIP)
+	}
+	if !slices.ContainsFunc(c.GetNetworks(mn.External), func(n *models.V1MachineNetwork) bool {
+		return slices.Contains(n.Ips, f.PublicIP)
+	}) {
+		return fmt.Errorf("public ip %s is not an ip of an external network", f.PublicIP)
+	}
+
+	target, err := netip.ParseAddr(f.TargetIP)
+	if err != nil {
+		return fmt.Errorf("invalid target ip %q", f.TargetIP)
+	}
+	if public.Is4() != target.Is4() {
+		return errors.New("public ip and target ip must be of the same address family")
+	}
+	if c.getPrivateNetworkOf(target) == nil {
+		return fmt.Errorf("target ip %s is not within a prefix of a private network", f.TargetIP)
+	}
+
+	for _, p := range f.From {
+		if _, err := getAddressFamily(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPrivateNetworkOf returns the private network with a prefix containing the given address, nil if there is none.
+func (c config) getPrivateNetworkOf(addr netip.Addr) *models.V1MachineNetwork {
+	for _, n := range c.GetNetworks(mn.PrivatePrimaryUnshared, mn.PrivatePrimaryShared, mn.PrivateSecondaryShared) {
+		for _, p := range n.Prefixes {
+			prefix, err := netip.ParsePrefix(p)
+			if err == nil && prefix.Contains(addr) {
+				return n
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f portForward) family() string {
+	if strings.Contains(f.PublicIP, ":") {
+		return "ip6"
+	}
+
+	return "ip"
+}
+
+// targetPort returns the port or port range the service listens on.
+func (f portForward) targetPort() string {
+	if f.TargetPort != "" {
+		return f.TargetPort
+	}
+
+	return f.Port
+}
+
+// preroutingRule returns the rule rewriting the destination of traffic to the public IP.
+func (f portForward) preroutingRule() NftRule {
+	af := f.family()
+	protocol := firewallRule{Protocol: f.Protocol}.protocol()
+
+	var matches []NftMatch
+	if from := filterAddressFamily(f.From, af); len(from) > 0 {
+		matches = append(matches, nftMatch(af+" saddr", from...))
+	}
+	matches = append(matches, nftMatch(af+" daddr", f.PublicIP), nftMatch(protocol+" dport", f.Port))
+
+	to := f.TargetIP
+	if af == "ip6" {
+		to = "[" + to + "]"
+	}
+	if f.TargetPort != "" {
+		to += ":" + f.TargetPort
+	}
+
+	return NftRule{
+		Matches:    matches,
+		Statements: []NftStatement{NftDNAT{Family: af, To: to}},
+		Comment:    f.Comment,
+	}
+}
+
+// forwardRule returns the rule accepting the forwarded traffic to the target.
+func (f portForward) forwardRule() NftRule {
+	af := f.family()
+	protocol := firewallRule{Protocol: f.Protocol}.protocol()
+
+	return NftRule{
+		Matches: []NftMatch{
+			nftMatch(af+" daddr", f.TargetIP),
+			nftMatch(protocol+" dport", f.targetPort()),
+			nftMatch("ct status", "dnat"),
+		},
+		Statements: []NftStatement{NftCounter{}},
+		Verdict:    NftAccept,
+		Comment:    f.Comment,
+	}
+}
+
+// hairpinRule returns the rule masquerading traffic from the network of the target to the public IP. Without it the
+// target would answer directly to the source, which expects the answer from the public IP.
+func (f portForward) hairpinRule(c config) (NftRule, bool) {
+	af := f.family()
+	protocol := firewallRule{Protocol: f.Protocol}.protocol()
+
+	target, err := netip.ParseAddr(f.TargetIP)
+	if err != nil {
+		return NftRule{}, false
+	}
+	n := c.getPrivateNetworkOf(target)
+	if n == nil {
+		return NftRule{}, false
+	}
+
+	comment := "hairpin nat"
+	if f.Comment != "" {
+		comment = f.Comment + " hairpin nat"
+	}
+
+	return NftRule{
+		Matches: []NftMatch{
+			nftMatch(af+" saddr", filterAddressFamily(n.Prefixes, af)...),
+			nftMatch(af+" daddr", f.TargetIP),
+			nftMatch(protocol+" dport", f.targetPort()),
+			nftMatch("ct status", "dnat"),
+		},
+		Statements: []NftStatement{NftCounter{}, NftMasquerade{}},
+		Comment:    comment,
+	}, true
+}
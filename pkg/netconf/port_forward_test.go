@@ -0,0 +1,65 @@
+package netconf
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortForward_Validate(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		forward portForward
+		wantErr string
+	}{
+		{
+			name:    "single port",
+			forward: portForward{PublicIP: "185.1.2.3", Port: "80", TargetIP: "10.0.16.10", TargetPort: "8080"},
+		},
+		{
+			name:    "port range to private secondary network",
+			forward: portForward{Protocol: "UDP", PublicIP: "185.1.2.3", Port: "5000-5010", TargetIP: "10.0.18.10"},
+		},
+		{
+			name:    "unsupported protocol",
+			forward: portForward{Protocol: "icmp", PublicIP: "185.1.2.3", Port: "80", TargetIP: "10.0.16.10"},
+			wantErr: `unsupported protocol "icmp"`,
+		},
+		{
+			name:    "target port for port range",
+			forward: portForward{PublicIP: "185.1.2.3", Port: "5000-5010", TargetIP: "10.0.16.10", TargetPort: "6000"},
+			wantErr: "target port must not be given for port ranges",
+		},
+		{
+			name:    "public ip of private network",
+			forward: portForward{PublicIP: "10.0.16.2", Port: "80", TargetIP: "10.0.16.10"},
+			wantErr: "public ip 10.0.16.2 is not an ip of an external network",
+		},
+		{
+			name:    "target outside of private networks",
+			forward: portForward{PublicIP: "185.1.2.3", Port: "80", TargetIP: "185.1.2.10"},
+			wantErr: "target ip 185.1.2.10 is not within a prefix of a private network",
+		},
+		{
+			name:    "mixed address families",
+			forward: portForward{PublicIP: "185.1.2.3", Port: "80", TargetIP: "fd00::1"},
+			wantErr: "public ip and target ip must be of the same address family",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.forward.validate(*kb)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package netconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+// reportPath is the path the report of the last configuration run is written to, next to the staging directory.
+const reportPath = tmpPath + "report.json"
+
+// Report describes what a configuration run changed on the bare metal server.
+type Report struct {
+	// Version is the version of the metal-networker that performed the run.
+	Version string `json:"version"`
+	// MachineUUID is the UUID of the configured machine.
+	MachineUUID string `json:"machine_uuid"`
+	// Started is the time the run started.
+	Started time.Time `json:"started"`
+	// Finished is the time the run finished.
+	Finished time.Time `json:"finished"`
+	// Error is the error the run failed with, it is empty if the run succeeded.
+	Error string `json:"error,omitempty"`
+	// Artifacts are all artifacts handled by the run.
+	Artifacts []ReportArtifact `json:"artifacts"`
+	// Units are all systemd units enabled by the run.
+	Units []ReportUnit `json:"units,omitempty"`
+}
+
+// ReportArtifact describes how a single artifact was handled.
+type ReportArtifact struct {
+	Destination  string `json:"destination"`
+	Mode         string `json:"mode"`
+	SHA256Before string `json:"sha256_before,omitempty"`
+	SHA256After  string `json:"sha256_after,omitempty"`
+	Validator    string `json:"validator,omitempty"`
+	Changed      bool   `json:"changed"`
+	Reloaded     bool   `json:"reloaded"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ReportUnit describes the attempt to enable a systemd unit.
+type ReportUnit struct {
+	Unit    string `json:"unit"`
+	Enabled bool   `json:"enabled"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newReport(c config, started, finished time.Time, artifacts []net.Artifact, units []ReportUnit, err error) Report {
+	r := Report{
+		Version:     version(),
+		MachineUUID: c.MachineUUID,
+		Started:     started,
+		Finished:    finished,
+		Artifacts:   []ReportArtifact{},
+		Units:       units,
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	for _, a := range artifacts {
+		ra := ReportArtifact{
+			Destination:  a.Dest,
+			Mode:         fmt.Sprintf("%#o", a.Mode.Perm()),
+			SHA256Before: a.SHA256Before,
+			SHA256After:  a.SHA256After,
+			Validator:    a.Validator,
+			Changed:      a.Changed,
+			Reloaded:     a.Reloaded,
+		}
+		if a.Err != nil {
+			ra.Error = a.Err.Error()
+		}
+		r.Artifacts = append(r.Artifacts, ra)
+	}
+
+	return r
+}
+
+// newReportUnit returns the report of enabling the given unit that failed with the given error, if any.
+func newReportUnit(unit string, err error) ReportUnit {
+	if err != nil {
+		return ReportUnit{Unit: unit, Error: err.Error()}
+	}
+
+	return ReportUnit{Unit: unit, Enabled: true}
+}
+
+// write writes the report as JSON to the given file, the previous report is replaced atomically.
+func (r Report) write(file string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	err = os.WriteFile(tmp, append(content, '\n'), fileModeSixFourFour)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// finish records the outcome of a configuration run in the metrics, if enabled, and writes its report.
+// Failures to do so are logged only, the returned error is the error of the run.
+func finish(c config, o options, started time.Time, artifacts []net.Artifact, units []ReportUnit, err error) error {
+	now := time.Now()
+
+	if o.metrics != nil {
+		textfile := o.path(o.metrics.textfile)
+		merr := o.metrics.observe(textfile, artifacts, err, now)
+		if merr != nil {
+			c.log.Warn("failed to write metrics", "textfile", textfile, "error", merr)
+		}
+	}
+
+	file := o.path(reportPath)
+	rerr := newReport(c, started, now, artifacts, units, err).write(file)
+	if rerr != nil {
+		c.log.Warn("failed to write report", "file", file, "error", rerr)
+	}
+
+	return err
+}
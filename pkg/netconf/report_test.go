@@ -0,0 +1,79 @@
+package netconf
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/metal-hammer/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metal-stack/metal-networker/pkg/net"
+)
+
+func TestFinish_WritesReport(t *testing.T) {
+	o := newOptions(WithRoot(t.TempDir()))
+	c := config{InstallerConfig: api.InstallerConfig{MachineUUID: "e0ab02d2-27cd-5a5e-8efc-080ba80cf258"}, log: slog.Default()}
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	artifacts := []net.Artifact{
+		{
+			Dest:         "/etc/frr/frr.conf",
+			Mode:         fileModeDefault,
+			Validator:    "netconf.frrValidator",
+			SHA256Before: "before",
+			SHA256After:  "after",
+			Changed:      true,
+			Reloaded:     true,
+		},
+	}
+	enableErr := &net.ApplyError{Artifact: "droptailer.service", Phase: net.PhaseEnable, Err: errors.New("failed")}
+	units := []ReportUnit{
+		newReportUnit("node-exporter.service", nil),
+		newReportUnit("droptailer.service", enableErr),
+	}
+
+	err := finish(c, o, started, artifacts, units, enableErr)
+	require.ErrorIs(t, err, enableErr)
+
+	content, err := os.ReadFile(o.path(reportPath))
+	require.NoError(t, err)
+
+	var r Report
+	require.NoError(t, json.Unmarshal(content, &r))
+
+	assert.Equal(t, c.MachineUUID, r.MachineUUID)
+	assert.Equal(t, started, r.Started)
+	assert.False(t, r.Finished.Before(started))
+	assert.Equal(t, "enable of droptailer.service failed: failed", r.Error)
+	assert.Equal(t, []ReportArtifact{
+		{
+			Destination:  "/etc/frr/frr.conf",
+			Mode:         "0600",
+			SHA256Before: "before",
+			SHA256After:  "after",
+			Validator:    "netconf.frrValidator",
+			Changed:      true,
+			Reloaded:     true,
+		},
+	}, r.Artifacts)
+	assert.Equal(t, []ReportUnit{
+		{Unit: "node-exporter.service", Enabled: true},
+		{Unit: "droptailer.service", Error: "enable of droptailer.service failed: failed"},
+	}, r.Units)
+}
+
+func TestFinish_WritesMetricsBelowRoot(t *testing.T) {
+	o := newOptions(WithRoot(t.TempDir()), WithMetrics(NewMetrics(DefaultMetricsTextfile)))
+	c := config{log: slog.Default()}
+
+	err := finish(c, o, time.Now(), nil, nil, nil)
+	require.NoError(t, err)
+
+	_, err = os.Stat(o.path(DefaultMetricsTextfile))
+	require.NoError(t, err)
+}
@@ -0,0 +1,111 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/metal-stack/metal-go/api/models"
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+)
+
+// staticSNAT translates the source addresses of traffic leaving through an external network to dedicated IPs of
+// this network instead of masquerading it with the address of the outgoing interface.
+type staticSNAT struct {
+	Comment string `yaml:"comment"`
+	// Network is the id of the external network the traffic leaves through.
+	Network string `yaml:"network"`
+	// Sources are the source prefixes to translate, the prefixes of the private primary and DMZ networks are used if
+	// empty.
+	Sources []string `yaml:"sources"`
+	// To are the IPs of the external network to translate to. Several IPs of an address family form a pool, a source
+	// address is always translated to the same IP of the pool.
+	To []string `yaml:"to"`
+}
+
+// validateStaticSNAT checks that every static SNAT translates to IPs of its external network and that there are
+// sources for each address family of these IPs.
+func (c config) validateStaticSNAT() error {
+	var errs []error
+	for i, s := range c.Networker.SNAT {
+		if err := s.validate(c); err != nil {
+			errs = append(errs, fmt.Errorf("snat %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s staticSNAT) validate(c config) error {
+	n := c.getExternalNetwork(s.Network)
+	if n == nil {
+		return fmt.Errorf("network %q is not an external network", s.Network)
+	}
+
+	if len(s.To) == 0 {
+		return errors.New("no snat ips given")
+	}
+	for _, to := range s.To {
+		if _, err := netip.ParseAddr(to); err != nil {
+			return fmt.Errorf("invalid snat ip %q", to)
+		}
+		if !slices.Contains(n.Ips, to) {
+			return fmt.Errorf("snat ip %s is not an ip of network %s", to, s.Network)
+		}
+	}
+
+	for _, p := range s.Sources {
+		af, err := getAddressFamily(p)
+		if err != nil {
+			return err
+		}
+		if len(filterIPAddressFamily(s.To, af)) == 0 {
+			return fmt.Errorf("source prefix %s has no snat ip of its address family", p)
+		}
+	}
+
+	sources := s.sources(c)
+	for _, af := range []string{"ip", "ip6"} {
+		if len(filterIPAddressFamily(s.To, af)) > 0 && len(filterAddressFamily(sources, af)) == 0 {
+			return fmt.Errorf("no source prefixes of address family %s given", af)
+		}
+	}
+
+	return nil
+}
+
+// getExternalNetwork returns the external network with the given id, nil if there is none.
+func (c config) getExternalNetwork(id string) *models.V1MachineNetwork {
+	for _, n := range c.GetNetworks(mn.External) {
+		if n.Networkid != nil && *n.Networkid == id {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// sources returns the prefixes to translate.
+func (s staticSNAT) sources(c config) []string {
+	if len(s.Sources) > 0 {
+		return s.Sources
+	}
+
+	return getSNATPrefixes(c)
+}
+
+// snat returns the SNAT translating the sources when leaving through the given network.
+func (s staticSNAT) snat(c config, n *models.V1MachineNetwork) SNAT {
+	cmt := s.Comment
+	if cmt == "" {
+		cmt = fmt.Sprintf("static snat (networkid: %s)", s.Network)
+	}
+
+	return SNAT{
+		Comment:      cmt,
+		OutInterface: fmt.Sprintf("vlan%d", *n.Vrf),
+		SourceSpecs:  getSourceSpecs(s.sources(c)),
+		To:           s.To,
+	}
+}
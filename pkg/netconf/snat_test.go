@@ -0,0 +1,72 @@
+package netconf
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticSNAT_Validate(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall_static_snat.yaml")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		snat    staticSNAT
+		wantErr string
+	}{
+		{
+			name: "pool with default sources",
+			snat: staticSNAT{Network: "internet-vagrant-lab", To: []string{"185.1.2.4", "185.1.2.5", "2a02:c00:20::1"}},
+		},
+		{
+			name: "single ip for given sources",
+			snat: staticSNAT{Network: "internet-vagrant-lab", Sources: []string{"10.0.16.0/28"}, To: []string{"185.1.2.3"}},
+		},
+		{
+			name:    "private network",
+			snat:    staticSNAT{Network: "storage-net", To: []string{"10.0.18.2"}},
+			wantErr: `network "storage-net" is not an external network`,
+		},
+		{
+			name:    "no ips",
+			snat:    staticSNAT{Network: "internet-vagrant-lab"},
+			wantErr: "no snat ips given",
+		},
+		{
+			name:    "ip of another network",
+			snat:    staticSNAT{Network: "internet-vagrant-lab", To: []string{"100.127.129.1"}},
+			wantErr: "snat ip 100.127.129.1 is not an ip of network internet-vagrant-lab",
+		},
+		{
+			name:    "source without ip of its address family",
+			snat:    staticSNAT{Network: "internet-vagrant-lab", Sources: []string{"2002::/64"}, To: []string{"185.1.2.4"}},
+			wantErr: "source prefix 2002::/64 has no snat ip of its address family",
+		},
+		{
+			name:    "invalid source",
+			snat:    staticSNAT{Network: "internet-vagrant-lab", Sources: []string{"10.0.16.0"}, To: []string{"185.1.2.4"}},
+			wantErr: `netip.ParsePrefix("10.0.16.0"): no '/'`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.snat.validate(*kb)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNftSNAT_Nft(t *testing.T) {
+	assert.Equal(t, "snat ip to 185.1.2.4", NftSNAT{Family: "ip", To: []string{"185.1.2.4"}}.nft())
+	assert.Equal(t, "snat ip6 to jhash ip6 saddr mod 2 map { 0 : 2a02:c00:20::1, 1 : 2a02:c00:20::2 }",
+		NftSNAT{Family: "ip6", To: []string{"2a02:c00:20::1", "2a02:c00:20::2"}}.nft())
+}
@@ -1,8 +1,13 @@
 package netconf
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"strings"
 
+	"gopkg.in/yaml.v3"
+
 	"github.com/metal-stack/metal-networker/pkg/net"
 )
 
@@ -35,7 +40,34 @@ func newSuricataConfigApplier(kb config, tmpFile string) (net.Applier, error) {
 	return net.NewNetworkApplier(data, validator, nil), nil
 }
 
-// Validate validates suricata configuration.
+// Validate validates suricata configuration. It must be valid YAML and capture packets on at least one interface.
 func (v suricataConfigValidator) Validate() error {
-	return nil
+	content, err := os.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+
+	var c struct {
+		Vars     map[string]any `yaml:"vars"`
+		AFPacket []struct {
+			Interface string `yaml:"interface"`
+		} `yaml:"af-packet"`
+	}
+
+	err = yaml.Unmarshal(content, &c)
+	if err != nil {
+		return fmt.Errorf("invalid suricata configuration: %w", err)
+	}
+
+	if len(c.Vars) == 0 {
+		return errors.New("suricata configuration lacks vars")
+	}
+
+	for _, p := range c.AFPacket {
+		if p.Interface != "" && p.Interface != "default" {
+			return nil
+		}
+	}
+
+	return errors.New("suricata configuration does not capture on any interface")
 }
@@ -0,0 +1,31 @@
+package netconf
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuricataConfigValidator(t *testing.T) {
+	kb, err := New(slog.Default(), "testdata/firewall.yaml")
+	require.NoError(t, err)
+
+	f := path.Join(t.TempDir(), "suricata.yaml")
+	a, err := newSuricataConfigApplier(*kb, f)
+	require.NoError(t, err)
+
+	out, err := os.Create(f)
+	require.NoError(t, err)
+	require.NoError(t, a.Render(out, *MustParseTpl(tplSuricataConfig)))
+	require.NoError(t, out.Close())
+	require.NoError(t, a.Validate())
+
+	require.NoError(t, os.WriteFile(f, []byte("%YAML 1.1\n---\nvars:\n  a: b\naf-packet:\n  - interface: default\n"), 0600))
+	require.EqualError(t, a.Validate(), "suricata configuration does not capture on any interface")
+
+	require.NoError(t, os.WriteFile(f, []byte("vars: [\n"), 0600))
+	require.ErrorContains(t, a.Validate(), "invalid suricata configuration")
+}
@@ -18,6 +18,8 @@ const (
 	mtuFirewall = 9216
 	// mtuMachine defines the value for MTU specific to the needs of a machine.
 	mtuMachine = 9000
+	// systemdNetworkdService is the name of the systemd unit that applies systemd.network and systemd.netdev files.
+	systemdNetworkdService = "systemd-networkd.service"
 )
 
 type (
@@ -33,33 +35,43 @@ type (
 		MAC        string
 		MTU        int
 		EVPNIfaces []EVPNIface
+		// Bond is the bond the interface is a member of, empty if it is not bonded.
+		Bond string
 	}
 
-	// systemdValidator validates systemd.network and system.link files.
+	// systemdValidator validates systemd.network, systemd.netdev and system.link files.
 	systemdValidator struct {
-		path string
+		path  string
+		dest  string
+		names *unitNames
 	}
 )
 
 // newSystemdNetworkdApplier creates a new Applier to configure systemd.network.
-func newSystemdNetworkdApplier(tmpFile string, data any) net.Applier {
-	validator := systemdValidator{tmpFile}
+func newSystemdNetworkdApplier(tmpFile, dest string, names *unitNames, data any) net.Applier {
+	validator := systemdValidator{path: tmpFile, dest: dest, names: names}
 
-	return net.NewNetworkApplier(data, validator, nil)
+	return net.NewNetworkApplier(data, validator, net.NewDBusReloader(systemdNetworkdService))
 }
 
-// newSystemdLinkApplier creates a new Applier to configure systemd.link.
-func newSystemdLinkApplier(kind BareMetalType, machineUUID string, nicIndex int, nic *models.V1MachineNic,
-	tmpFile string, evpnIfaces []EVPNIface) (net.Applier, error) {
-	var mtu int
-
+// getMTU returns the MTU of the lan interfaces and their bond for the given kind of bare metal server.
+func getMTU(kind BareMetalType) (int, error) {
 	switch kind {
 	case Firewall:
-		mtu = mtuFirewall
+		return mtuFirewall, nil
 	case Machine:
-		mtu = mtuMachine
+		return mtuMachine, nil
 	default:
-		return nil, fmt.Errorf("unknown configuratorType of configurator: %d", kind)
+		return 0, fmt.Errorf("unknown configuratorType of configurator: %d", kind)
+	}
+}
+
+// newSystemdLinkApplier creates a new Applier to configure systemd.link. Members of a bond get the MTU of the bond.
+func newSystemdLinkApplier(kind BareMetalType, machineUUID string, nicIndex int, nic *models.V1MachineNic,
+	tmpFile, dest string, names *unitNames, evpnIfaces []EVPNIface, bond string) (net.Applier, error) {
+	mtu, err := getMTU(kind)
+	if err != nil {
+		return nil, err
 	}
 
 	data := SystemdLinkData{
@@ -70,13 +82,15 @@ func newSystemdLinkApplier(kind BareMetalType, machineUUID string, nicIndex int,
 		MTU:        mtu,
 		MAC:        *nic.Mac,
 		EVPNIfaces: evpnIfaces,
+		Bond:       bond,
 	}
-	validator := systemdValidator{tmpFile}
+	validator := systemdValidator{path: tmpFile, dest: dest, names: names}
 
-	return net.NewNetworkApplier(data, validator, nil), nil
+	return net.NewNetworkApplier(data, validator, net.NewDBusReloader(systemdNetworkdService)), nil
 }
 
-// Validate validates systemd.network and systemd.link files.
+// Validate validates systemd.network, systemd.netdev and systemd.link files against their schema and ensures that
+// no other file validated along with it matches the same interface.
 func (v systemdValidator) Validate() error {
-	return nil
+	return validateUnitFile(v.path, v.dest, v.names)
 }
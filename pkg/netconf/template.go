@@ -9,15 +9,22 @@ import (
 //go:embed tpl
 var templates embed.FS
 
-func mustReadTpl(tplName string) string {
+func readTpl(tplName string) (string, error) {
 	contents, err := templates.ReadFile(path.Join("tpl", tplName))
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return string(contents)
+	return string(contents), nil
+}
+
+func parseTpl(tplName string) (*template.Template, error) {
+	s, err := readTpl(tplName)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(tplName).Parse(s)
 }
 
 func MustParseTpl(tplName string) *template.Template {
-	s := mustReadTpl(tplName)
-	return template.Must(template.New(tplName).Parse(string(s)))
+	return template.Must(parseTpl(tplName))
 }
@@ -0,0 +1,3 @@
+{{- /*gotype: github.com/metal-stack/metal-networker/pkg/netconf.ConntrackData*/ -}}
+{{ .Comment }}
+nf_conntrack
@@ -0,0 +1,5 @@
+{{- /*gotype: github.com/metal-stack/metal-networker/pkg/netconf.ConntrackData*/ -}}
+{{ .Comment }}
+{{- range .Sysctls }}
+{{ .Key }} = {{ .Value }}
+{{- end }}
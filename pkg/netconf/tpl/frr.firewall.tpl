@@ -17,23 +17,21 @@ vrf vrf{{ .ID}}
  vni {{ .VNI }}
  exit-vrf
 {{ end -}}
-!
-interface lan0
- ipv6 nd ra-interval 6
- no ipv6 nd suppress-ra
-!
-interface lan1
+!{{- range .Interfaces }}
+interface {{ . }}
  ipv6 nd ra-interval 6
  no ipv6 nd suppress-ra
 !
+{{- end }}
 router bgp {{ .ASN }}
  bgp router-id {{ .RouterID }}
  bgp bestpath as-path multipath-relax
  neighbor FABRIC peer-group
  neighbor FABRIC remote-as external
  neighbor FABRIC timers 2 8
- neighbor lan0 interface peer-group FABRIC
- neighbor lan1 interface peer-group FABRIC
+{{- range .Interfaces }}
+ neighbor {{ . }} interface peer-group FABRIC
+{{- end }}
  !
  address-family ipv4 unicast
   redistribute connected route-map LOOPBACKS
@@ -12,15 +12,12 @@ debug bgp updates
 debug bgp nht
 debug bgp update-groups
 debug bgp zebra
-!
-interface lan0
- ipv6 nd ra-interval 6
- no ipv6 nd suppress-ra
-!
-interface lan1
+!{{- range .Interfaces }}
+interface {{ . }}
  ipv6 nd ra-interval 6
  no ipv6 nd suppress-ra
 !
+{{- end }}
 no zebra nexthop kernel enable
 !
 router bgp {{ .ASN }}
@@ -29,8 +26,9 @@ router bgp {{ .ASN }}
  neighbor TOR peer-group
  neighbor TOR remote-as external
  neighbor TOR timers 2 8
- neighbor lan0 interface peer-group TOR
- neighbor lan1 interface peer-group TOR
+{{- range .Interfaces }}
+ neighbor {{ . }} interface peer-group TOR
+{{- end }}
  neighbor LOCAL peer-group
  neighbor LOCAL remote-as internal
  neighbor LOCAL timers 2 8
@@ -4,7 +4,11 @@
 Name=lan{{ .Index }}
 
 [Network]
+{{- if .Bond }}
+Bond={{ .Bond }}
+{{- else }}
 IPv6AcceptRA=no
 {{- range .EVPNIfaces }}
 VXLAN=vni{{ .VXLAN.ID }}
+{{- end }}
 {{- end }}
\ No newline at end of file
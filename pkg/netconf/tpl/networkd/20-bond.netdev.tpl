@@ -0,0 +1,15 @@
+{{- /*gotype: github.com/metal-stack/metal-networker/internal/netconf.BondData*/ -}}
+{{ .Comment }}
+[NetDev]
+Name={{ .Name }}
+Kind=bond
+MTUBytes={{ .MTU }}
+
+[Bond]
+Mode=802.3ad
+LACPTransmitRate={{ .TransmitRate }}
+TransmitHashPolicy={{ .TransmitHashPolicy }}
+MIIMonitorSec={{ .MIIMonitorSec }}
+{{- if .MinLinks }}
+MinLinks={{ .MinLinks }}
+{{- end }}
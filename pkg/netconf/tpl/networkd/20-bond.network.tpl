@@ -0,0 +1,7 @@
+{{- /*gotype: github.com/metal-stack/metal-networker/internal/netconf.BondData*/ -}}
+{{ .Comment }}
+[Match]
+Name={{ .Name }}
+
+[Network]
+IPv6AcceptRA=no
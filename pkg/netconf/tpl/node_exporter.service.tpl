@@ -5,7 +5,7 @@ Description=Node exporter - provides prometheus metrics about the node
 After=network.target
 
 [Service]
-ExecStart=/usr/local/bin/node_exporter --collector.tcpstat
+ExecStart=/usr/local/bin/node_exporter --collector.tcpstat --collector.textfile.directory=/var/lib/node_exporter/textfile_collector
 Restart=always
 RestartSec=30
 
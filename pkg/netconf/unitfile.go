@@ -0,0 +1,539 @@
+package netconf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	// unitSection is a section of a systemd unit file.
+	unitSection struct {
+		name    string
+		line    int
+		entries []unitEntry
+	}
+
+	// unitEntry is a single assignment within a section of a systemd unit file.
+	unitEntry struct {
+		key   string
+		value string
+		line  int
+	}
+
+	// unitValueCheck checks the value of a single key of a unit file.
+	unitValueCheck func(value string) error
+
+	// unitSchema maps the known sections of a unit file type to their known keys and an optional check of their values.
+	unitSchema map[string]map[string]unitValueCheck
+
+	// unitNames tracks the interfaces claimed by systemd-networkd files that are validated together.
+	// Files matching the same interface or declaring the same netdev shadow each other silently in systemd-networkd.
+	unitNames struct {
+		claimed map[string]string
+	}
+)
+
+// unitSchemas holds the schema of every supported unit file type by its file extension.
+// The schemas only contain the subset of systemd.network(5), systemd.netdev(5), systemd.link(5) and systemd.service(5)
+// that is relevant to the networker, unknown sections and keys are rejected.
+var unitSchemas = map[string]unitSchema{
+	".network": {
+		"Match": {
+			"Name": checkInterfaceNames, "MACAddress": checkMACs, "PermanentMACAddress": checkMACs, "Path": nil,
+			"Driver": nil, "Type": nil, "Kind": nil, "Property": nil, "Host": nil, "Virtualization": nil,
+			"KernelCommandLine": nil, "Architecture": nil,
+		},
+		"Link": {
+			"MACAddress": checkMAC, "MTUBytes": checkMTU, "ARP": checkBool, "Multicast": checkBool,
+			"AllMulticast": checkBool, "Unmanaged": checkBool, "RequiredForOnline": nil, "ActivationPolicy": nil,
+		},
+		"Network": {
+			"Description": nil, "DHCP": nil, "LinkLocalAddressing": nil, "IPv6AcceptRA": checkBool,
+			"IPv6LinkLocalAddressGenerationMode": nil, "Address": checkPrefix, "Gateway": checkAddr, "DNS": checkAddr,
+			"Domains": nil, "NTP": nil, "IPForward": nil, "IPMasquerade": nil, "LLDP": nil, "EmitLLDP": nil,
+			"Bridge": checkInterfaceName, "Bond": checkInterfaceName, "VRF": checkInterfaceName,
+			"VLAN": checkInterfaceName, "MACVLAN": checkInterfaceName, "VXLAN": checkInterfaceName,
+			"Tunnel": checkInterfaceName, "ConfigureWithoutCarrier": checkBool, "IgnoreCarrierLoss": nil,
+			"KeepConfiguration": nil,
+		},
+		"Address": {
+			"Address": checkPrefix, "Peer": checkPrefix, "Broadcast": nil, "Label": nil, "PreferredLifetime": nil,
+			"Scope": nil, "RouteMetric": checkUint(0, 1<<32-1),
+		},
+		"Route": {
+			"Gateway": checkAddr, "Destination": checkPrefix, "Source": checkPrefix, "PreferredSource": checkAddr,
+			"Metric": checkUint(0, 1<<32-1), "Table": nil, "Scope": nil, "Type": nil, "GatewayOnLink": checkBool,
+		},
+		"RoutingPolicyRule": {
+			"From": checkPrefix, "To": checkPrefix, "Table": nil, "Priority": checkUint(0, 1<<32-1),
+			"IncomingInterface": checkInterfaceName, "OutgoingInterface": checkInterfaceName, "Family": nil,
+		},
+		"Bridge": {
+			"Cost": nil, "Priority": nil, "HairPin": checkBool, "Isolated": checkBool, "Learning": checkBool,
+			"NeighborSuppression": checkBool, "UnicastFlood": checkBool, "MulticastFlood": checkBool,
+		},
+		"BridgeVLAN": {
+			"VLAN": checkVLANRange, "EgressUntagged": checkVLANRange, "PVID": checkVLANID,
+		},
+	},
+	".netdev": {
+		"Match": {
+			"Host": nil, "Virtualization": nil, "KernelCommandLine": nil, "Architecture": nil,
+		},
+		"NetDev": {
+			"Name": checkInterfaceName, "Kind": checkNetdevKind, "Description": nil, "MTUBytes": checkMTU,
+			"MACAddress": checkMAC,
+		},
+		"Bridge": {
+			"DefaultPVID": checkDefaultPVID, "VLANFiltering": checkBool, "STP": checkBool, "HelloTimeSec": nil,
+			"MaxAgeSec": nil, "ForwardDelaySec": nil, "AgeingTimeSec": nil, "Priority": checkUint(0, 65535),
+			"MulticastSnooping": checkBool, "MulticastQuerier": checkBool, "VLANProtocol": nil,
+		},
+		"VLAN": {
+			"Id": checkVLANID, "Protocol": nil, "GVRP": checkBool, "MVRP": checkBool, "LooseBinding": checkBool,
+			"ReorderHeader": checkBool,
+		},
+		"VRF": {
+			"Table": checkUint(1, 1<<32-1),
+		},
+		"VXLAN": {
+			"VNI": checkUint(1, 1<<24-1), "Remote": checkAddr, "Local": checkAddr, "Group": checkAddr,
+			"TOS": checkUint(0, 255), "TTL": nil, "MacLearning": checkBool, "FDBAgeingSec": nil,
+			"MaximumFDBEntries": nil, "ReduceARPProxy": checkBool, "L2MissNotification": checkBool,
+			"L3MissNotification": checkBool, "RouteShortCircuit": checkBool, "UDPChecksum": checkBool,
+			"UDP6ZeroChecksumTx": checkBool, "UDP6ZeroChecksumRx": checkBool, "RemoteChecksumTx": checkBool,
+			"RemoteChecksumRx": checkBool, "GroupPolicyExtension": checkBool, "GenericProtocolExtension": checkBool,
+			"DestinationPort": checkUint(1, 65535), "PortRange": nil, "FlowLabel": nil, "IPDoNotFragment": nil,
+			"Independent": checkBool,
+		},
+		"Bond": {
+			"Mode": nil, "TransmitHashPolicy": nil, "LACPTransmitRate": nil, "MIIMonitorSec": nil,
+			"UpDelaySec": nil, "DownDelaySec": nil, "MinLinks": nil, "AdSelect": nil,
+		},
+	},
+	".link": {
+		"Match": {
+			"MACAddress": checkMACs, "PermanentMACAddress": checkMACs, "OriginalName": checkInterfaceNames,
+			"Path": nil, "Driver": nil, "Type": nil, "Property": nil, "Host": nil, "Virtualization": nil,
+			"KernelCommandLine": nil, "Architecture": nil,
+		},
+		"Link": {
+			"Description": nil, "Alias": nil, "MACAddressPolicy": nil, "MACAddress": checkMAC, "NamePolicy": nil,
+			"Name": checkInterfaceName, "AlternativeNamesPolicy": nil, "AlternativeName": nil, "MTUBytes": checkMTU,
+			"BitsPerSecond": nil, "Duplex": nil, "AutoNegotiation": checkBool, "WakeOnLan": nil, "Port": nil,
+			"ReceiveChecksumOffload": checkBool, "TransmitChecksumOffload": checkBool,
+			"TCPSegmentationOffload": checkBool, "GenericSegmentationOffload": checkBool,
+			"GenericReceiveOffload": checkBool, "LargeReceiveOffload": checkBool, "RxChannels": nil,
+			"TxChannels": nil, "OtherChannels": nil, "CombinedChannels": nil, "RxBufferSize": nil,
+			"TxBufferSize": nil,
+		},
+	},
+	".service": {
+		"Unit": {
+			"Description": nil, "Documentation": nil, "After": nil, "Before": nil, "Requires": nil, "Wants": nil,
+			"BindsTo": nil, "PartOf": nil, "Conflicts": nil, "Requisite": nil, "ConditionPathExists": nil,
+			"StartLimitIntervalSec": nil, "StartLimitBurst": nil, "DefaultDependencies": checkBool,
+		},
+		"Service": {
+			"Type": checkServiceType, "ExecStart": nil, "ExecStartPre": nil, "ExecStartPost": nil, "ExecStop": nil,
+			"ExecStopPost": nil, "ExecReload": nil, "Restart": checkRestart, "RestartSec": nil,
+			"TimeoutSec": nil, "TimeoutStartSec": nil, "TimeoutStopSec": nil, "WatchdogSec": nil,
+			"Environment": nil, "EnvironmentFile": nil, "User": nil, "Group": nil, "WorkingDirectory": nil,
+			"LimitMEMLOCK": nil, "LimitNOFILE": nil, "RuntimeDirectory": nil, "RuntimeDirectoryMode": nil,
+			"StateDirectory": nil, "StateDirectoryMode": nil, "CacheDirectory": nil, "CacheDirectoryMode": nil,
+			"LogsDirectory": nil, "KillMode": nil, "KillSignal": nil, "RemainAfterExit": checkBool, "PIDFile": nil,
+			"NotifyAccess": nil, "Nice": nil, "AmbientCapabilities": nil, "CapabilityBoundingSet": nil,
+			"NoNewPrivileges": checkBool, "ProtectSystem": nil, "ProtectHome": nil, "PrivateTmp": checkBool,
+			"StandardOutput": nil, "StandardError": nil, "SyslogIdentifier": nil, "SuccessExitStatus": nil,
+		},
+		"Install": {
+			"WantedBy": nil, "RequiredBy": nil, "Alias": nil, "Also": nil, "DefaultInstance": nil,
+		},
+	},
+}
+
+// requiredUnitKeys lists the keys that must be present in a unit file type by its file extension.
+var requiredUnitKeys = map[string]map[string][]string{
+	".network": {"Match": nil},
+	".netdev":  {"NetDev": {"Name", "Kind"}},
+	".link":    {"Match": nil, "Link": nil},
+	".service": {"Service": {"ExecStart"}},
+}
+
+// newUnitNames creates a new empty tracker of the interfaces claimed by systemd-networkd files.
+func newUnitNames() *unitNames {
+	return &unitNames{claimed: map[string]string{}}
+}
+
+// claim registers the given key for the given file and fails if it is already claimed by another file.
+func (n *unitNames) claim(key, file string) error {
+	if n == nil {
+		return nil
+	}
+
+	if other, ok := n.claimed[key]; ok && other != file {
+		return fmt.Errorf("%s is already claimed by %s", key, other)
+	}
+	n.claimed[key] = file
+
+	return nil
+}
+
+// validateUnitFile parses the unit file at path that is going to be written to dest and checks it against the schema
+// of its type given by the file extension of dest. Names claimed by the file are registered at names, which may be nil.
+// All problems found are returned joined.
+func validateUnitFile(path, dest string, names *unitNames) error {
+	ext := filepath.Ext(dest)
+	schema, ok := unitSchemas[ext]
+	if !ok {
+		return fmt.Errorf("unsupported unit file type %q", ext)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	sections, err := parseUnitFile(content)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, s := range sections {
+		keys, ok := schema[s.name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("line %d: unknown section [%s]", s.line, s.name))
+			continue
+		}
+
+		for _, e := range s.entries {
+			check, ok := keys[e.key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("line %d: unknown key %s in section [%s]", e.line, e.key, s.name))
+				continue
+			}
+
+			if check == nil || e.value == "" {
+				continue
+			}
+
+			err := check(e.value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: invalid %s: %w", e.line, e.key, err))
+			}
+		}
+	}
+
+	for section, required := range requiredUnitKeys[ext] {
+		if !hasUnitSection(sections, section) {
+			errs = append(errs, fmt.Errorf("missing section [%s]", section))
+			continue
+		}
+
+		for _, key := range required {
+			if unitValue(sections, section, key) == "" {
+				errs = append(errs, fmt.Errorf("missing key %s in section [%s]", key, section))
+			}
+		}
+	}
+
+	errs = append(errs, claimUnitNames(sections, ext, names, dest)...)
+
+	return errors.Join(errs...)
+}
+
+// claimUnitNames registers the [Match] section of .network and .link files and the name of .netdev files.
+func claimUnitNames(sections []unitSection, ext string, names *unitNames, dest string) []error {
+	var errs []error
+
+	switch ext {
+	case ".network", ".link":
+		for _, s := range sections {
+			if s.name != "Match" {
+				continue
+			}
+
+			var match []string
+			seen := map[string]bool{}
+			for _, e := range s.entries {
+				for _, v := range strings.Fields(e.value) {
+					if e.key == "Name" && seen[v] {
+						errs = append(errs, fmt.Errorf("line %d: duplicate name %s in section [Match]", e.line, v))
+					}
+					seen[v] = true
+				}
+				match = append(match, e.key+"="+e.value)
+			}
+			slices.Sort(match)
+
+			err := names.claim(fmt.Sprintf("[Match] %s of %s files", strings.Join(match, " "), ext), dest)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case ".netdev":
+		name := unitValue(sections, "NetDev", "Name")
+		if name == "" {
+			break
+		}
+
+		err := names.claim(fmt.Sprintf("netdev %s", name), dest)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// parseUnitFile parses the INI-style format of systemd unit files.
+func parseUnitFile(content []byte) ([]unitSection, error) {
+	var (
+		sections []unitSection
+		current  *unitSection
+		pending  *unitEntry
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if pending != nil {
+			continued := strings.HasSuffix(line, "\\")
+			pending.value += " " + strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+			if !continued {
+				current.entries = append(current.entries, *pending)
+				pending = nil
+			}
+			continue
+		}
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("line %d: invalid section header %q", n, line)
+			}
+			sections = append(sections, unitSection{name: line[1 : len(line)-1], line: n})
+			current = &sections[len(sections)-1]
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("line %d: assignment outside of a section", n)
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: invalid assignment %q", n, line)
+		}
+
+		e := unitEntry{key: key, value: strings.TrimSpace(value), line: n}
+		if strings.HasSuffix(e.value, "\\") {
+			e.value = strings.TrimSpace(strings.TrimSuffix(e.value, "\\"))
+			pending = &e
+			continue
+		}
+		current.entries = append(current.entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if pending != nil {
+		current.entries = append(current.entries, *pending)
+	}
+
+	return sections, nil
+}
+
+func hasUnitSection(sections []unitSection, name string) bool {
+	return slices.ContainsFunc(sections, func(s unitSection) bool { return s.name == name })
+}
+
+// unitValue returns the last value assigned to the given key in any section with the given name.
+func unitValue(sections []unitSection, section, key string) string {
+	var result string
+
+	for _, s := range sections {
+		if s.name != section {
+			continue
+		}
+		for _, e := range s.entries {
+			if e.key == key {
+				result = e.value
+			}
+		}
+	}
+
+	return result
+}
+
+func checkUint(lowest, highest uint64) unitValueCheck {
+	return func(value string) error {
+		i, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+
+		if i < lowest || i > highest {
+			return fmt.Errorf("%d is not within %d-%d", i, lowest, highest)
+		}
+
+		return nil
+	}
+}
+
+// checkMTU checks an MTU, which must be large enough for IPv4.
+var checkMTU = checkUint(68, 65535)
+
+// checkVLANID checks a single VLAN ID.
+var checkVLANID = checkUint(1, 4094)
+
+// checkVLANRange checks a single VLAN ID or a range of VLAN IDs like 1000-1010.
+func checkVLANRange(value string) error {
+	first, last, isRange := strings.Cut(value, "-")
+	if err := checkVLANID(first); err != nil {
+		return err
+	}
+
+	if !isRange {
+		return nil
+	}
+
+	if err := checkVLANID(last); err != nil {
+		return err
+	}
+
+	f, _ := strconv.Atoi(first)
+	l, _ := strconv.Atoi(last)
+	if f > l {
+		return fmt.Errorf("range %s is empty", value)
+	}
+
+	return nil
+}
+
+func checkDefaultPVID(value string) error {
+	if value == "none" {
+		return nil
+	}
+
+	return checkVLANID(value)
+}
+
+func checkBool(value string) error {
+	switch strings.ToLower(value) {
+	case "1", "yes", "y", "true", "t", "on", "0", "no", "n", "false", "f", "off":
+		return nil
+	}
+
+	return fmt.Errorf("%q is not a boolean", value)
+}
+
+func checkPrefix(value string) error {
+	_, err := netip.ParsePrefix(value)
+	if err == nil {
+		return nil
+	}
+
+	// systemd accepts addresses without prefix length as well
+	_, err = netip.ParseAddr(value)
+	if err != nil {
+		return fmt.Errorf("%q is neither a prefix nor an address", value)
+	}
+
+	return nil
+}
+
+func checkAddr(value string) error {
+	_, err := netip.ParseAddr(value)
+	if err != nil {
+		return fmt.Errorf("%q is not an address", value)
+	}
+
+	return nil
+}
+
+func checkMAC(value string) error {
+	hw, err := net.ParseMAC(value)
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("%q is not a MAC address", value)
+	}
+
+	return nil
+}
+
+func checkMACs(value string) error {
+	for _, v := range strings.Fields(value) {
+		if err := checkMAC(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkInterfaceName checks a name of a network interface, which is limited to 15 characters by the kernel.
+func checkInterfaceName(value string) error {
+	if len(value) > 15 || value == "." || value == ".." || strings.ContainsAny(value, "/: \t") {
+		return fmt.Errorf("%q is not a valid interface name", value)
+	}
+
+	return nil
+}
+
+// checkInterfaceNames checks a whitespace separated list of interface names that may contain glob patterns.
+func checkInterfaceNames(value string) error {
+	for _, v := range strings.Fields(value) {
+		if _, err := filepath.Match(v, ""); err != nil {
+			return fmt.Errorf("%q is not a valid pattern", v)
+		}
+		if err := checkInterfaceName(strings.TrimPrefix(v, "!")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkNetdevKind(value string) error {
+	switch value {
+	case "bond", "bridge", "dummy", "vlan", "vrf", "vxlan", "veth", "macvlan", "ipvlan", "wireguard", "gre", "sit":
+		return nil
+	}
+
+	return fmt.Errorf("unsupported kind %q", value)
+}
+
+func checkServiceType(value string) error {
+	switch value {
+	case "simple", "exec", "forking", "oneshot", "dbus", "notify", "notify-reload", "idle":
+		return nil
+	}
+
+	return fmt.Errorf("unknown type %q", value)
+}
+
+func checkRestart(value string) error {
+	switch value {
+	case "no", "always", "on-success", "on-failure", "on-abnormal", "on-abort", "on-watchdog":
+		return nil
+	}
+
+	return fmt.Errorf("unknown restart setting %q", value)
+}
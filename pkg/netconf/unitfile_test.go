@@ -0,0 +1,150 @@
+package netconf
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateUnitFile_Testdata(t *testing.T) {
+	files, err := filepath.Glob("testdata/networkd/*/*")
+	require.NoError(t, err)
+	services, err := filepath.Glob("testdata/*.service")
+	require.NoError(t, err)
+	files = append(files, services...)
+	require.NotEmpty(t, files)
+
+	names := map[string]*unitNames{}
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if names[dir] == nil {
+			names[dir] = newUnitNames()
+		}
+		assert.NoError(t, validateUnitFile(f, f, names[dir]), f)
+	}
+}
+
+func TestValidateUnitFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		dest    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "valid network",
+			dest:    "10-lan0.network",
+			content: "# comment\n[Match]\nName=lan0\n\n[Network]\nAddress=10.0.0.1/32\nVXLAN=vni3981\n",
+		},
+		{
+			name:    "line continuation",
+			dest:    "x.service",
+			content: "[Service]\nExecStart=/bin/ip vrf exec vrf1 \\\n  /usr/bin/true\n",
+		},
+		{
+			name:    "unknown section",
+			dest:    "10-lan0.network",
+			content: "[Match]\nName=lan0\n[Netwrok]\nAddress=10.0.0.1/32\n",
+			wantErr: "line 3: unknown section [Netwrok]",
+		},
+		{
+			name:    "unknown key",
+			dest:    "10-lan0.network",
+			content: "[Match]\nName=lan0\n[Network]\nAdress=10.0.0.1/32\n",
+			wantErr: "line 4: unknown key Adress in section [Network]",
+		},
+		{
+			name:    "invalid address",
+			dest:    "10-lan0.network",
+			content: "[Match]\nName=lan0\n[Address]\nAddress=10.0.0.300/32\n",
+			wantErr: "line 4: invalid Address",
+		},
+		{
+			name:    "mtu out of range",
+			dest:    "10-lan0.link",
+			content: "[Match]\nPermanentMACAddress=00:03:00:11:11:01\n[Link]\nMTUBytes=65536\n",
+			wantErr: "line 4: invalid MTUBytes: 65536 is not within 68-65535",
+		},
+		{
+			name:    "invalid mac",
+			dest:    "10-lan0.link",
+			content: "[Match]\nPermanentMACAddress=00:03:00:11:11\n[Link]\nName=lan0\n",
+			wantErr: "is not a MAC address",
+		},
+		{
+			name:    "vlan id out of range",
+			dest:    "30-svi.netdev",
+			content: "[NetDev]\nName=vlan1\nKind=vlan\n[VLAN]\nId=4095\n",
+			wantErr: "line 5: invalid Id: 4095 is not within 1-4094",
+		},
+		{
+			name:    "vni out of range",
+			dest:    "30-vxlan.netdev",
+			content: "[NetDev]\nName=vni1\nKind=vxlan\n[VXLAN]\nVNI=16777216\n",
+			wantErr: "line 5: invalid VNI",
+		},
+		{
+			name:    "interface name too long",
+			dest:    "30-vrf.netdev",
+			content: "[NetDev]\nName=vrf1234567890123\nKind=vrf\n",
+			wantErr: "is not a valid interface name",
+		},
+		{
+			name:    "missing netdev kind",
+			dest:    "30-vrf.netdev",
+			content: "[NetDev]\nName=vrf1\n",
+			wantErr: "missing key Kind in section [NetDev]",
+		},
+		{
+			name:    "duplicate match name",
+			dest:    "10-lan0.network",
+			content: "[Match]\nName=lan0 lan0\n",
+			wantErr: "line 2: duplicate name lan0 in section [Match]",
+		},
+		{
+			name:    "service without exec start",
+			dest:    "x.service",
+			content: "[Unit]\nDescription=x\n[Service]\nRestart=always\n",
+			wantErr: "missing key ExecStart in section [Service]",
+		},
+		{
+			name:    "assignment outside of section",
+			dest:    "x.service",
+			content: "ExecStart=/bin/true\n",
+			wantErr: "line 1: assignment outside of a section",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := path.Join(t.TempDir(), "tmp")
+			require.NoError(t, os.WriteFile(f, []byte(tt.content), 0600))
+
+			err := validateUnitFile(f, tt.dest, nil)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestValidateUnitFile_DuplicateMatch(t *testing.T) {
+	dir := t.TempDir()
+	f := path.Join(dir, "tmp")
+	require.NoError(t, os.WriteFile(f, []byte("[Match]\nName=lan0\n[Network]\nVRF=vrf1\n"), 0600))
+
+	names := newUnitNames()
+	require.NoError(t, validateUnitFile(f, "/etc/systemd/network/10-lan0.network", names))
+	require.NoError(t, validateUnitFile(f, "/etc/systemd/network/10-lan0.network", names), "revalidation must not conflict")
+
+	err := validateUnitFile(f, "/etc/systemd/network/11-lan0.network", names)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already claimed by /etc/systemd/network/10-lan0.network")
+}